@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/draganm/bolted"
 	"github.com/draganm/bolted/watcher"
+	"github.com/draganm/boltimore/clock"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
@@ -14,10 +14,11 @@ import (
 type RequestContext struct {
 	Request         *http.Request
 	ResponseWriter  http.ResponseWriter
-	DB              *bolted.Bolted
+	DB              *DB
 	responseWritten bool
 	Watcher         *watcher.Watcher
 	Logger          *zap.SugaredLogger
+	Clock           clock.Clock
 }
 
 func (r *RequestContext) RouteVariable(name string) string {
@@ -58,15 +59,19 @@ func (r *RequestContext) RespondWithError(error string, statusCode int) error {
 func (b *Boltimore) addEndpoint(method, path string, action func(rc *RequestContext) error) {
 
 	b.Router.Methods(method).Path(path).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the database is replaced while swapMu is held for writing
+		b.swapMu.RLock()
 		rc := &RequestContext{
 			Request:        req,
 			ResponseWriter: w,
 			DB:             b.DB,
 			Watcher:        b.Watcher,
 			Logger:         b.logger.With("endpoint", fmt.Sprintf("%s %s", method, path)),
+			Clock:          b.clock,
 		}
 
 		err := action(rc)
+		b.swapMu.RUnlock()
 
 		if err != nil {
 			if !rc.responseWritten {
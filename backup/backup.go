@@ -2,15 +2,38 @@ package backup
 
 import (
 	"io"
-	"path"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
 	"github.com/draganm/bolted/dump"
 	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
 	"github.com/pkg/errors"
 )
 
-func BackupEndpoint(rc *boltimore.RequestContext) (err error) {
+// prefixParameter is the query parameter selecting the map to back up or restore.
+const prefixParameter = "prefix"
+
+const (
+	allowUnverifiedParameter = "allowUnverified"
+	modeParameter            = "mode"
+	dryRunParameter          = "dryRun"
+)
+
+func BackupEndpoint(rc *boltimore.RequestContext) error {
+	return newConfig(nil).backupEndpoint(rc)
+}
+
+// NewBackupEndpoint returns BackupEndpoint encrypting the dump with the configured key.
+func NewBackupEndpoint(opts ...Option) func(rc *boltimore.RequestContext) error {
+	return newConfig(opts).backupEndpoint
+}
+
+func (c *config) backupEndpoint(rc *boltimore.RequestContext) (err error) {
 
 	defer func() {
 		if err != nil {
@@ -18,49 +41,247 @@ func BackupEndpoint(rc *boltimore.RequestContext) (err error) {
 		}
 	}()
 
-	return rc.DB.Read(func(tx bolted.ReadTx) error {
-		tw := dump.NewWriter(rc.ResponseWriter)
-		toDo := []string{""}
-		for len(toDo) > 0 {
-			head := toDo[0]
-			toDo = toDo[1:]
+	query := rc.Request.URL.Query()
+	prefix := query.Get(prefixParameter)
+
+	if c.snapshots != nil && query.Get(snapshotParameter) != "" {
+		err = c.snapshots.serve(rc.ResponseWriter, rc.Request, query.Get(snapshotParameter), rc.Clock.Now())
+		if err == errSnapshotNotFound {
+			return rc.RespondWithError(err.Error(), 404)
+		}
+
+		if err != nil {
+			return rc.RespondWithError(err.Error(), 400)
+		}
+
+		return nil
+	}
+
+	var since *uint64
+	if query.Get(sinceParameter) != "" {
+		s, err := strconv.ParseUint(query.Get(sinceParameter), 10, 64)
+		if err != nil {
+			return rc.RespondWithError(errors.Wrapf(err, "while parsing %s", sinceParameter).Error(), 400)
+		}
+		since = &s
+	}
+
+	compression, contentEncoding, err := negotiateCompression(rc.Request)
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	var snapshotID string
+
+	err = rc.DB.Read(func(tx bolted.ReadTx) error {
+		found, err := paths.IsMap(tx, prefix)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return rc.RespondWithError("map not found", 404)
+		}
+
+		var m *Manifest
+		write := func(w io.Writer) (err error) {
+			m, err = backup(tx, prefix, w)
+			return err
+		}
 
-			if head != "" {
-				_, err = tw.CreateMap(head)
-				if err != nil {
-					return err
-				}
+		if since != nil {
+			_, err = checkSince(tx, *since)
+			if errors.Cause(err) == ErrUnknownBackup {
+				return rc.RespondWithError(err.Error(), 404)
 			}
 
 			if err != nil {
-				errors.Wrapf(err, "while writing dir header for %s", head)
+				return err
 			}
 
-			it, err := tx.Iterator(head)
-			if err != nil {
-				return errors.Wrapf(err, "while creating iterator for %s", head)
+			write = func(w io.Writer) (err error) {
+				m, err = backupSince(tx, prefix, *since, w)
+				return err
 			}
+		}
 
-			for ; !it.Done; it.Next() {
-				pth := path.Join(head, it.Key)
+		h := rc.ResponseWriter.Header()
+
+		hasChangeLog, _, err := paths.Lookup(tx, changeLogMapName)
+		if err != nil {
+			return err
+		}
 
-				if it.Value == nil {
-					toDo = append(toDo, pth)
-					continue
-				}
+		if hasChangeLog {
+			seq, err := ChangeSequence(tx)
+			if err != nil {
+				return err
+			}
+			h.Set(backupIDHeader, strconv.FormatUint(seq, 10))
+		}
 
-				_, err = tw.Put(path.Join(head, it.Key), it.Value)
-				if err != nil {
-					return err
-				}
+		h.Add("Vary", "Accept-Encoding")
+		switch {
+		case c.encrypted():
+			// the dump is compressed before it is encrypted, so the
+			// response can't be decoded by the client
+			h.Set("Content-Type", compressionContentType(CompressionNone))
+		case contentEncoding:
+			h.Set("Content-Type", compressionContentType(CompressionNone))
+			h.Set("Content-Encoding", compression)
+		default:
+			h.Set("Content-Type", compressionContentType(compression))
+		}
 
+		if c.snapshots != nil {
+			snapshotID, err = c.snapshots.create(rc.Clock.Now(), func(w io.Writer) error {
+				return c.writeBackup(compression, w, write)
+			})
+			if err != nil {
+				return err
 			}
+
+			manifestHeaders(h, m)
+			return c.snapshots.saveHeaders(snapshotID, h)
 		}
+
+		// the manifest is only known once the dump has been written
+		h.Set("Trailer", strings.Join([]string{backupEntriesHeader, backupBytesHeader, backupSHA256Header}, ", "))
+
+		err = c.writeBackup(compression, rc.ResponseWriter, write)
+		if err != nil {
+			return err
+		}
+
+		manifestHeaders(h, m)
 		return nil
 	})
+	if err != nil || snapshotID == "" {
+		return err
+	}
+
+	// the snapshot is sent after the read transaction has been closed
+	return c.snapshots.serve(rc.ResponseWriter, rc.Request, snapshotID, rc.Clock.Now())
+}
+
+// writeBackup writes the dump written by write into w, compressing and
+// encrypting it as configured.
+func (c *config) writeBackup(compression string, w io.Writer, write func(w io.Writer) error) error {
+	var ew io.WriteCloser = nopWriteCloser{w}
+	if c.encrypted() {
+		var err error
+		ew, err = c.encryptingWriter(w)
+		if err != nil {
+			return errors.Wrap(err, "while starting encryption")
+		}
+	}
+
+	cw, err := compressingWriter(ew, compression)
+	if err != nil {
+		return err
+	}
+
+	err = write(cw)
+	if err != nil {
+		return err
+	}
+
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+
+	return ew.Close()
+}
+
+// openDump decodes the content encoding and decrypts the dump.
+func (c *config) openDump(r io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	decoded := ioutil.NopCloser(r)
+	if contentEncoding != "" {
+		var err error
+		decoded, err = decompressingReader(r, contentEncoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dr, err := c.decryptingReader(decoded)
+	if err != nil {
+		decoded.Close()
+		return nil, invalidDump{err}
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{dr, decoded}, nil
+}
+
+// Backup writes a dump of the map at prefix and everything below it,
+// followed by the manifest of the dump.
+// An empty prefix dumps the whole database except for internal maps that
+// are not backed up, like the change log and indexes.
+func Backup(tx bolted.ReadTx, prefix string, w io.Writer) error {
+	_, err := backup(tx, prefix, w)
+	return err
+}
+
+// isExcluded returns whether pth is within an internal map that is not
+// backed up, see boltimore.RegisterInternalMap. Those maps are neither part
+// of dumps nor written by restores.
+func isExcluded(pth string) bool {
+	internal, backedUp := boltimore.InternalMap(pth)
+	return internal && !backedUp
+}
+
+// isInternal returns whether pth is within an internal map, those maps are
+// neither exported nor imported as JSON.
+func isInternal(pth string) bool {
+	internal, _ := boltimore.InternalMap(pth)
+	return internal
+}
+
+func backup(tx bolted.ReadTx, prefix string, w io.Writer) (*Manifest, error) {
+	prefix, err := paths.Normalize(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tw := newDumpWriter(w)
+
+	tw.manifest.Sequence, err = ChangeSequence(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = walk(tx, prefix, func(pth string, value []byte) error {
+		if isExcluded(pth) {
+			return errSkipMap
+		}
+
+		if value == nil {
+			err := tw.CreateMap(pth)
+			return errors.Wrapf(err, "while writing map header for %s", pth)
+		}
+		return tw.Put(pth, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tw.manifest, tw.Close()
+}
+
+func RestoreEndpoint(rc *boltimore.RequestContext) error {
+	return newConfig(nil).restoreEndpoint(rc)
+}
+
+// NewRestoreEndpoint returns RestoreEndpoint decrypting dumps with the configured key.
+func NewRestoreEndpoint(opts ...Option) func(rc *boltimore.RequestContext) error {
+	return newConfig(opts).restoreEndpoint
 }
 
-func RestoreEndpoint(rc *boltimore.RequestContext) (err error) {
+func (c *config) restoreEndpoint(rc *boltimore.RequestContext) (err error) {
 
 	defer func() {
 		if err != nil {
@@ -68,54 +289,589 @@ func RestoreEndpoint(rc *boltimore.RequestContext) (err error) {
 		}
 	}()
 
-	return rc.DB.Write(func(tx bolted.WriteTx) error {
-		it, err := tx.Iterator("")
+	query := rc.Request.URL.Query()
+	opts := RestoreOptions{
+		Prefix:          query.Get(prefixParameter),
+		AllowUnverified: query.Get(allowUnverifiedParameter) == "true",
+		Mode:            RestoreMode(query.Get(modeParameter)),
+		DryRun:          query.Get(dryRunParameter) == "true",
+	}
+
+	err = opts.Mode.validate()
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	opts.Rewrites, err = rewritesFromQuery(query)
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	err = checkRewritePrefix(opts.Mode, opts.Prefix, opts.Rewrites)
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	body, err := c.openDump(rc.Request.Body, rc.Request.Header.Get("Content-Encoding"))
+	if isInvalidDump(err) {
+		return rc.RespondWithError(err.Error(), 422)
+	}
+
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 415)
+	}
+	defer body.Close()
+
+	var report *RestoreReport
+	err = rc.DB.Write(func(tx bolted.WriteTx) error {
+		report, err = RestoreWithOptions(tx, body, opts)
+		return err
+	})
+
+	if err == ErrDryRun {
+		return rc.RespondWithJSON(report)
+	}
+
+	if isInvalidDump(err) {
+		return rc.RespondWithError(err.Error(), 422)
+	}
+
+	return err
+}
+
+type RestoreMode string
+
+const (
+	// RestoreReplace replaces everything below the prefix with the content of the dump.
+	RestoreReplace RestoreMode = "replace"
+	// RestoreMerge writes the entries of the dump, overwriting existing ones
+	// and keeping entries missing from the dump.
+	RestoreMerge RestoreMode = "merge"
+	// RestoreSkipExisting writes only the entries of the dump which don't exist yet.
+	RestoreSkipExisting RestoreMode = "skip-existing"
+)
+
+func (m RestoreMode) validate() error {
+	switch m {
+	case "", RestoreReplace, RestoreMerge, RestoreSkipExisting:
+		return nil
+	default:
+		return errors.Errorf("unsupported restore mode %q", m)
+	}
+}
+
+type RestoreOptions struct {
+	// Prefix is the map to restore, empty for the whole database.
+	Prefix string
+	// AllowUnverified permits restoring dumps without a manifest,
+	// such as dumps created before manifests were introduced.
+	AllowUnverified bool
+	// Mode defaults to RestoreReplace.
+	Mode RestoreMode
+	// DryRun collects a report of the changes and returns ErrDryRun after
+	// the dump has been replayed, so the transaction is rolled back.
+	DryRun bool
+	// Rewrites move entries of the dump to other paths, Prefix refers to
+	// the rewritten paths. Rewrites in replace mode require a Prefix.
+	Rewrites []Rewrite
+}
+
+// RestoreReport lists the paths changed by a dry run restore.
+type RestoreReport struct {
+	Mode        RestoreMode `json:"mode"`
+	Created     []string    `json:"created"`
+	Overwritten []string    `json:"overwritten"`
+	Deleted     []string    `json:"deleted"`
+	Skipped     []string    `json:"skipped"`
+}
+
+var ErrDryRun = errors.New("restore dry run")
+
+var errIncrementalReplace = invalidDump{errors.New("incremental dumps can't be restored in replace mode")}
+
+// Restore replaces the map at prefix with its content from the dump.
+// Entries of the dump outside of prefix are ignored, so a single map can be
+// restored from a dump of the whole database.
+// An empty prefix replaces the whole database.
+// Gzip and zstd compressed dumps are detected and decompressed.
+// The restore fails, leaving the transaction to be rolled back, when the dump
+// does not match its manifest or has none.
+func Restore(tx bolted.WriteTx, prefix string, r io.Reader) error {
+	_, err := RestoreWithOptions(tx, r, RestoreOptions{Prefix: prefix})
+	return err
+}
+
+// RestoreWithOptions restores the dump like Restore in the configured mode.
+// Incremental dumps can't be restored in replace mode.
+// The report is only returned for dry runs.
+func RestoreWithOptions(tx bolted.WriteTx, r io.Reader, opts RestoreOptions) (*RestoreReport, error) {
+	report, _, err := restoreDump(tx, r, opts)
+	return report, err
+}
+
+// RestoreChain restores a full dump followed by incremental dumps, each
+// based on the dump before it. The full dump is restored in the configured
+// mode, the incremental dumps are merged.
+func RestoreChain(tx bolted.WriteTx, dumps []io.Reader, opts RestoreOptions) error {
+	if opts.DryRun {
+		return errors.New("dry run is not supported for chains of dumps")
+	}
+
+	var previous *Manifest
+	for i, r := range dumps {
+		o := opts
+		if i > 0 {
+			o.Mode = RestoreMerge
+		}
+
+		_, m, err := restoreDump(tx, r, o)
+		if err != nil {
+			return errors.Wrapf(err, "while restoring dump %d", i)
+		}
+
+		if m == nil {
+			return invalidDump{errors.Errorf("dump %d has no manifest", i)}
+		}
+
+		if i == 0 && m.Since != 0 {
+			return invalidDump{errors.Errorf("first dump is an incremental dump since %d", m.Since)}
+		}
+
+		if i > 0 && m.Since != previous.Sequence {
+			return invalidDump{errors.Errorf("dump %d is based on backup %d, not on %d", i, m.Since, previous.Sequence)}
+		}
+
+		previous = m
+	}
+
+	return nil
+}
+
+func restoreDump(tx bolted.WriteTx, r io.Reader, opts RestoreOptions) (*RestoreReport, *Manifest, error) {
+	err := opts.Mode.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts.Mode == "" {
+		opts.Mode = RestoreReplace
+	}
+
+	prefix, err := paths.Normalize(opts.Prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rewrites, err := normalizeRewrites(opts.Rewrites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = checkRewritePrefix(opts.Mode, prefix, rewrites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dr, err := decompressingReader(r, "")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "while opening compressed dump")
+	}
+	defer dr.Close()
+
+	rs := &restorer{
+		tx:     tx,
+		mode:   opts.Mode,
+		dryRun: opts.DryRun,
+		report: &RestoreReport{
+			Mode:        opts.Mode,
+			Created:     []string{},
+			Overwritten: []string{},
+			Deleted:     []string{},
+			Skipped:     []string{},
+		},
+	}
+
+	err = rs.prepare(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr := newDumpReader(dr)
+
+	for {
+		nx, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, nil, invalidDump{errors.Wrap(err, "while reading next dump entry")}
+		}
+
+		key, err := paths.Normalize(nx.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, rewritten := rewrite(rewrites, key)
+
+		if key == prefix || !isWithin(key, prefix) || isExcluded(key) {
+			continue
+		}
+
+		if rewritten {
+			// the parents of a rewritten map are not part of the dump
+			err = rs.createParents(key, prefix)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		switch nx.Type {
+		case dump.Put, dump.CreateMap:
+			err = rs.restore(key, nx.Type == dump.CreateMap, nx.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+		case Deletion:
+			if opts.Mode == RestoreReplace {
+				return nil, nil, errIncrementalReplace
+			}
+			err = rs.delete(key)
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, errors.Errorf("unsupported type %d", nx.Type)
+		}
+
+	}
+
+	m := tr.Manifest()
+	if m == nil && !opts.AllowUnverified {
+		return nil, nil, invalidDump{ErrUnverified}
+	}
+
+	if m != nil && m.Since != 0 && opts.Mode == RestoreReplace {
+		return nil, nil, errIncrementalReplace
+	}
+
+	if !rs.dryRun {
+		return nil, m, nil
+	}
+
+	for pth := range rs.existing {
+		rs.report.Deleted = append(rs.report.Deleted, pth)
+	}
+	sort.Strings(rs.report.Deleted)
+
+	return rs.report, m, ErrDryRun
+}
+
+type restorer struct {
+	tx     bolted.WriteTx
+	mode   RestoreMode
+	dryRun bool
+	report *RestoreReport
+	// existing holds the paths below the prefix before a replace that
+	// haven't been restored yet, only tracked for dry runs
+	existing map[string]bool
+	// skipped holds the maps whose content is skipped
+	skipped []string
+}
+
+func (rs *restorer) prepare(prefix string) error {
+	if rs.mode != RestoreReplace {
+		if prefix == "" {
+			return nil
+		}
+
+		ex, err := rs.tx.Exists(prefix)
+		if err != nil || ex {
+			return err
+		}
+
+		return rs.tx.CreateMap(prefix)
+	}
+
+	if rs.dryRun {
+		rs.existing = map[string]bool{}
+		err := walk(rs.tx, prefix, func(pth string, value []byte) error {
+			if isExcluded(pth) {
+				return errSkipMap
+			}
+			if pth != prefix {
+				rs.existing[pth] = value == nil
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		keysToDelete := []string{}
+	// the change log has to keep counting across restores and the indexes
+	// are rebuilt by their listener
+	return clear(rs.tx, prefix, isExcluded)
+}
 
-		for ; !it.Done; it.Next() {
-			keysToDelete = append(keysToDelete, it.Key)
+func (rs *restorer) restore(key string, createMap bool, value []byte) error {
+	for _, s := range rs.skipped {
+		if isWithin(key, s) {
+			rs.note(&rs.report.Skipped, key)
+			return nil
+		}
+	}
+
+	existed, wasMap, err := rs.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !existed:
+		rs.note(&rs.report.Created, key)
+	case createMap && wasMap:
+		// the map is kept, its content is restored entry by entry
+		if rs.mode == RestoreReplace {
+			err = rs.tx.CreateMap(key)
+			return errors.Wrapf(err, "while creating map %s", key)
+		}
+		return nil
+	case rs.mode == RestoreSkipExisting:
+		if createMap {
+			rs.skipped = append(rs.skipped, key)
+		}
+		rs.note(&rs.report.Skipped, key)
+		return nil
+	default:
+		rs.note(&rs.report.Overwritten, key)
+	}
+
+	if existed && rs.mode != RestoreReplace && (createMap || wasMap) {
+		err = rs.tx.Delete(key)
+		if err != nil {
+			return errors.Wrapf(err, "while deleting %s", key)
+		}
+	}
+
+	if createMap {
+		err = rs.tx.CreateMap(key)
+		return errors.Wrapf(err, "while creating map %s", key)
+	}
+
+	err = rs.tx.Put(key, value)
+	return errors.Wrapf(err, "while writing %s", key)
+}
+
+func (rs *restorer) delete(key string) error {
+	ex, _, err := paths.Lookup(rs.tx, key)
+	if err != nil || !ex {
+		return err
+	}
+
+	if rs.mode == RestoreSkipExisting {
+		rs.note(&rs.report.Skipped, key)
+		return nil
+	}
+
+	if rs.existing != nil {
+		// reported as deleted at the end of a dry run
+		delete(rs.existing, key)
+	}
+	rs.note(&rs.report.Deleted, key)
+
+	return rs.tx.Delete(key)
+}
+
+// createParents creates the missing maps between prefix and key.
+func (rs *restorer) createParents(key, prefix string) error {
+	parts, _ := dbpath.Split(key)
+	for i := 1; i < len(parts); i++ {
+		p := dbpath.Join(parts[:i]...)
+		if !isWithin(p, prefix) || p == prefix {
+			continue
+		}
+
+		ex, err := rs.tx.Exists(p)
+		if err != nil {
+			return err
+		}
+
+		if ex {
+			continue
+		}
+
+		existed, wasMap := false, false
+		if rs.mode == RestoreReplace {
+			existed, wasMap, _ = rs.lookup(p)
+		}
+
+		err = rs.tx.CreateMap(p)
+		if err != nil {
+			return errors.Wrapf(err, "while creating map %s", p)
+		}
+
+		switch {
+		case !existed:
+			rs.note(&rs.report.Created, p)
+		case !wasMap:
+			rs.note(&rs.report.Overwritten, p)
+		}
+	}
+	return nil
+}
+
+func (rs *restorer) note(list *[]string, key string) {
+	if rs.dryRun {
+		*list = append(*list, key)
+	}
+}
+
+// lookup returns whether the key existed before the restore and whether it was a map.
+func (rs *restorer) lookup(key string) (bool, bool, error) {
+	if rs.mode == RestoreReplace {
+		wasMap, existed := rs.existing[key]
+		delete(rs.existing, key)
+		return existed, wasMap, nil
+	}
+
+	return paths.Lookup(rs.tx, key)
+}
+
+// VerifyEndpoint checks an uploaded dump against its manifest without
+// touching the database and responds with the manifest.
+func VerifyEndpoint(rc *boltimore.RequestContext) error {
+	return newConfig(nil).verifyEndpoint(rc)
+}
+
+// NewVerifyEndpoint returns VerifyEndpoint decrypting dumps with the configured key.
+func NewVerifyEndpoint(opts ...Option) func(rc *boltimore.RequestContext) error {
+	return newConfig(opts).verifyEndpoint
+}
+
+func (c *config) verifyEndpoint(rc *boltimore.RequestContext) error {
+	body, err := c.openDump(rc.Request.Body, rc.Request.Header.Get("Content-Encoding"))
+	if err != nil && !isInvalidDump(err) {
+		return rc.RespondWithError(err.Error(), 415)
+	}
+
+	var m *Manifest
+	if err == nil {
+		defer body.Close()
+		m, err = Verify(body)
+	}
+
+	if err != nil {
+		return rc.RespondWithStatusCodeAndJSON(422, map[string]interface{}{
+			"valid": false,
+			"error": err.Error(),
+		})
+	}
+
+	return rc.RespondWithJSON(map[string]interface{}{
+		"valid":    true,
+		"manifest": m,
+	})
+}
+
+// invalidDump marks errors caused by the content of the dump rather than by the database.
+type invalidDump struct {
+	error
+}
+
+func isInvalidDump(err error) bool {
+	_, ok := err.(invalidDump)
+	return ok
+}
+
+// clear removes everything from the map at prefix, creating it if it does not exist.
+func clear(tx bolted.WriteTx, prefix string, keep func(pth string) bool) error {
+	if prefix != "" {
+		ex, err := tx.Exists(prefix)
+		if err != nil {
+			return err
 		}
 
-		for _, k := range keysToDelete {
-			err = tx.Delete(k)
+		if ex {
+			err = tx.Delete(prefix)
 			if err != nil {
-				return errors.Wrapf(err, "while deleting %s", k)
+				return errors.Wrapf(err, "while deleting %s", prefix)
 			}
 		}
 
-		tr := dump.NewReader(rc.Request.Body)
+		return tx.CreateMap(prefix)
+	}
+
+	it, err := tx.Iterator("")
+	if err != nil {
+		return err
+	}
+
+	keysToDelete := []string{}
+
+	for ; !it.Done; it.Next() {
+		if !keep(dbpath.Join(it.Key)) {
+			keysToDelete = append(keysToDelete, it.Key)
+		}
+	}
+
+	for _, k := range keysToDelete {
+		pth := dbpath.Join(k)
+		err = tx.Delete(pth)
+		if err != nil {
+			return errors.Wrapf(err, "while deleting %s", pth)
+		}
+	}
+
+	return nil
+}
+
+var errSkipMap = errors.New("skip map")
+
+// walk calls fn for the map at prefix and everything below it in breadth first
+// order, passing nil as the value of maps.
+// When fn returns errSkipMap for a map, its content is skipped.
+func walk(tx bolted.ReadTx, prefix string, fn func(pth string, value []byte) error) error {
+	toDo := []string{prefix}
+	for len(toDo) > 0 {
+		head := toDo[0]
+		toDo = toDo[1:]
 
-		for {
-			nx, err := tr.Next()
-			if err == io.EOF {
-				break
+		if head != "" {
+			err := fn(head, nil)
+			if err == errSkipMap {
+				continue
 			}
 
 			if err != nil {
-				return errors.Wrap(err, "while reading next tar entry")
+				return err
 			}
+		}
+
+		it, err := tx.Iterator(head)
+		if err != nil {
+			return errors.Wrapf(err, "while creating iterator for %s", head)
+		}
 
-			switch nx.Type {
-			case dump.Put:
-				err = tx.Put(nx.Key, nx.Value)
-				if err != nil {
-					return errors.Wrapf(err, "while writing %s", nx.Key)
-				}
-			case dump.CreateMap:
-				err = tx.CreateMap(nx.Key)
-				if err != nil {
-					return errors.Wrapf(err, "wile creating map %s", nx.Key)
-				}
-			default:
-				return errors.Errorf("unsupported type %d", nx.Type)
+		for ; !it.Done; it.Next() {
+			pth := dbpath.Append(head, it.Key)
+
+			if it.Value == nil {
+				toDo = append(toDo, pth)
+				continue
 			}
 
+			err = fn(pth, it.Value)
+			if err != nil {
+				return err
+			}
 		}
+	}
 
-		return nil
-	})
+	return nil
+}
+
+func isWithin(pth, prefix string) bool {
+	return prefix == "" || pth == prefix || strings.HasPrefix(pth, prefix+dbpath.Separator)
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/draganm/bolted"
@@ -97,3 +98,92 @@ func TestBackupAndRestore(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []string{"foo"}, maps)
 }
+
+func TestSubtreeBackupAndRestore(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+	)
+	require.NoError(t, err)
+
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		for _, m := range []string{"tenants", "tenants/acme", "tenants/acme/users", "tenants/other"} {
+			err = tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Put("tenants/acme/users/alice", []byte("alice"))
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("tenants/other/bob", []byte("bob"))
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?prefix=tenants/acme", nil))
+	require.Equal(t, 200, rec.Code)
+	subtreeBackup := rec.Body.Bytes()
+
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+	fullBackup := rec.Body.Bytes()
+
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?prefix=tenants/foo", nil))
+	require.Equal(t, 404, rec.Code)
+
+	modify := func() {
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			err = tx.Delete("tenants/acme/users")
+			if err != nil {
+				return err
+			}
+
+			err = tx.Put("tenants/acme/mallory", []byte("mallory"))
+			if err != nil {
+				return err
+			}
+
+			return tx.Put("tenants/other/carol", []byte("carol"))
+		})
+		require.NoError(t, err)
+	}
+
+	for _, bk := range [][]byte{subtreeBackup, fullBackup} {
+		modify()
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup?prefix=tenants/acme", bytes.NewReader(bk)))
+		require.Equal(t, 200, rec.Code)
+
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			v, err := tx.Get("tenants/acme/users/alice")
+			require.NoError(t, err)
+			require.Equal(t, []byte("alice"), v)
+
+			ex, err := tx.Exists("tenants/acme/mallory")
+			require.NoError(t, err)
+			require.False(t, ex)
+
+			ex, err = tx.Exists("tenants/other/carol")
+			require.NoError(t, err)
+			require.True(t, ex)
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Delete("tenants/other/carol")
+		})
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,397 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/bolted/dump"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+// Deletion is the item type of deleted paths in incremental dumps.
+const Deletion dump.ItemType = 0x3
+
+// The change log records the paths changed by each committed transaction
+// under a sequence number. The sequence number at the time of a backup is
+// its ID, incremental backups contain the current state of all paths changed
+// since.
+//
+// __changelog/sequence   sequence number of the last recorded transaction
+// __changelog/pruned     last sequence number removed from the log
+// __changelog/log/<seq>  JSON list of the paths changed by a transaction
+const (
+	changeLogMapName  = "__changelog"
+	sequenceKey       = "sequence"
+	prunedKey         = "pruned"
+	logMapName        = "log"
+	sinceParameter    = "since"
+	backupIDHeader    = "Backup-Id"
+	sequenceKeyFormat = "%020d"
+)
+
+func init() {
+	// the change log has to keep counting across restores
+	boltimore.RegisterInternalMap(changeLogMapName, false)
+}
+
+var ErrUnknownBackup = errors.New("unknown backup")
+
+// ChangeLog records the changes of committed transactions, which is needed
+// for incremental backups.
+func ChangeLog() boltimore.Option {
+	return func(b *boltimore.Boltimore) error {
+		err := boltimore.ChangeListener(&changeLog{mu: new(sync.Mutex)})(b)
+		if err != nil {
+			return err
+		}
+
+		return b.DB.Write(ensureChangeLogMaps)
+	}
+}
+
+func ensureChangeLogMaps(tx bolted.WriteTx) error {
+	for _, m := range []string{
+		changeLogMapName,
+		dbpath.Join(changeLogMapName, logMapName),
+	} {
+		ex, err := tx.Exists(m)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			err = tx.CreateMap(m)
+			if err != nil {
+				return errors.Wrapf(err, "while creating map %s", m)
+			}
+		}
+	}
+	return nil
+}
+
+// ChangeSequence returns the sequence number of the last recorded
+// transaction, which is the ID of a backup taken in tx.
+func ChangeSequence(tx bolted.ReadTx) (uint64, error) {
+	return readCounter(tx, sequenceKey)
+}
+
+// PruneChangeLog removes the changes up to and including seq from the change
+// log. Incremental backups can't be taken since backups with lower IDs anymore.
+func PruneChangeLog(tx bolted.WriteTx, seq uint64) error {
+	pruned, err := readCounter(tx, prunedKey)
+	if err != nil {
+		return err
+	}
+
+	if seq <= pruned {
+		return nil
+	}
+
+	logPath := dbpath.Join(changeLogMapName, logMapName)
+
+	it, err := tx.Iterator(logPath)
+	if err != nil {
+		return err
+	}
+
+	toDelete := []string{}
+	for ; !it.Done; it.Next() {
+		s, err := strconv.ParseUint(it.Key, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "while parsing sequence number %q", it.Key)
+		}
+
+		if s > seq {
+			break
+		}
+
+		toDelete = append(toDelete, it.Key)
+	}
+
+	for _, k := range toDelete {
+		err = tx.Delete(dbpath.Append(logPath, k))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeCounter(tx, prunedKey, seq)
+}
+
+// BackupSince writes an incremental dump of the map at prefix with the state
+// of all paths changed after the backup with the ID since was taken.
+// Deleted paths are written as Deletion entries, changed maps are written as
+// a Deletion followed by the map and all of its content.
+func BackupSince(tx bolted.ReadTx, prefix string, since uint64, w io.Writer) error {
+	_, err := backupSince(tx, prefix, since, w)
+	return err
+}
+
+func backupSince(tx bolted.ReadTx, prefix string, since uint64, w io.Writer) (*Manifest, error) {
+	prefix, err := paths.Normalize(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := checkSince(tx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+
+	it, err := tx.Iterator(dbpath.Join(changeLogMapName, logMapName))
+	if err != nil {
+		return nil, err
+	}
+
+	for it.Seek(fmt.Sprintf(sequenceKeyFormat, since+1)); !it.Done; it.Next() {
+		paths := []string{}
+		err = json.Unmarshal(it.Value, &paths)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing change log entry %s", it.Key)
+		}
+
+		for _, p := range paths {
+			if p != prefix && isWithin(p, prefix) {
+				changed[p] = true
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(changed))
+	for p := range changed {
+		sorted = append(sorted, p)
+	}
+
+	// parents sort before their children
+	sort.Strings(sorted)
+
+	tw := newDumpWriter(w)
+	tw.manifest.Sequence = seq
+	tw.manifest.Since = since
+
+	// paths below deleted or recreated maps are covered by their parent
+	covered := []string{}
+
+	for _, p := range sorted {
+		ex, m, err := paths.Lookup(tx, p)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ex {
+			if isCovered(covered, p) {
+				continue
+			}
+
+			err = tw.Delete(p)
+			if err != nil {
+				return nil, err
+			}
+
+			covered = append(covered, p)
+			continue
+		}
+
+		if !m {
+			v, err := tx.Get(p)
+			if err != nil {
+				return nil, err
+			}
+
+			err = tw.Put(p, v)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// a changed map was created after since, so all of its content
+		// has been changed as well and is written on its own
+		if !isCovered(covered, p) {
+			err = tw.Delete(p)
+			if err != nil {
+				return nil, err
+			}
+			covered = append(covered, p)
+		}
+
+		err = tw.CreateMap(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &tw.manifest, tw.Close()
+}
+
+func isCovered(covered []string, pth string) bool {
+	for _, c := range covered {
+		if pth != c && isWithin(pth, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSince returns the current sequence number if changes since the
+// backup can be read from the change log.
+func checkSince(tx bolted.ReadTx, since uint64) (uint64, error) {
+	ex, err := tx.Exists(changeLogMapName)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ex {
+		return 0, errors.Wrap(ErrUnknownBackup, "change log is not enabled")
+	}
+
+	seq, err := ChangeSequence(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	if since > seq {
+		return 0, errors.Wrapf(ErrUnknownBackup, "backup %d is newer than the change log", since)
+	}
+
+	pruned, err := readCounter(tx, prunedKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if since < pruned {
+		return 0, errors.Wrapf(ErrUnknownBackup, "changes since backup %d have been pruned", since)
+	}
+
+	return seq, nil
+}
+
+func readCounter(tx bolted.ReadTx, key string) (uint64, error) {
+	pth := dbpath.Join(changeLogMapName, key)
+
+	ex, _, err := paths.Lookup(tx, pth)
+	if err != nil || !ex {
+		return 0, err
+	}
+
+	v, err := tx.Get(pth)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "while parsing %s", pth)
+	}
+
+	return n, nil
+}
+
+func writeCounter(tx bolted.WriteTx, key string, n uint64) error {
+	return tx.Put(dbpath.Join(changeLogMapName, key), []byte(strconv.FormatUint(n, 10)))
+}
+
+// changeLog is the change listener recording the changed paths of each
+// committed transaction.
+type changeLog struct {
+	mu      *sync.Mutex
+	changed map[string]bool
+}
+
+func (c *changeLog) Opened(b *bolted.Bolted) error {
+	return nil
+}
+
+func (c *changeLog) Start(w bolted.WriteTx) error {
+	c.mu.Lock()
+	c.changed = map[string]bool{}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *changeLog) record(pth string) error {
+	pth, err := paths.Normalize(pth)
+	if err != nil {
+		return err
+	}
+
+	if isExcluded(pth) {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.changed[pth] = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *changeLog) Delete(w bolted.WriteTx, path string) error {
+	return c.record(path)
+}
+
+func (c *changeLog) CreateMap(w bolted.WriteTx, path string) error {
+	return c.record(path)
+}
+
+func (c *changeLog) Put(w bolted.WriteTx, path string, newValue []byte) error {
+	return c.record(path)
+}
+
+func (c *changeLog) BeforeCommit(w bolted.WriteTx) error {
+	c.mu.Lock()
+	changed := c.changed
+	c.changed = map[string]bool{}
+	c.mu.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	// the change log might be missing after a restore of the whole database
+	err := ensureChangeLogMaps(w)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(changed))
+	for p := range changed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	d, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+
+	seq, err := ChangeSequence(w)
+	if err != nil {
+		return err
+	}
+	seq++
+
+	err = w.Put(dbpath.Join(changeLogMapName, logMapName, fmt.Sprintf(sequenceKeyFormat, seq)), d)
+	if err != nil {
+		return errors.Wrap(err, "while writing change log")
+	}
+
+	return writeCounter(w, sequenceKey, seq)
+}
+
+func (c *changeLog) AfterTransaction(err error) error {
+	return nil
+}
+
+func (c *changeLog) Closed() error {
+	return nil
+}
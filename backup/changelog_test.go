@@ -0,0 +1,231 @@
+package backup_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func openWithChangeLog(t *testing.T) *boltimore.Boltimore {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		backup.ChangeLog(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func dumpContent(t *testing.T, b *boltimore.Boltimore) map[string]string {
+	content := map[string]string{}
+	err := b.DB.Read(func(tx bolted.ReadTx) error {
+		var walk func(pth string) error
+		walk = func(pth string) error {
+			it, err := tx.Iterator(pth)
+			if err != nil {
+				return err
+			}
+			for ; !it.Done; it.Next() {
+				p := pth + "/" + it.Key
+				if it.Key == "__changelog" {
+					continue
+				}
+				if it.Value == nil {
+					content[p] = "map"
+					err = walk(p)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				content[p] = string(it.Value)
+			}
+			return nil
+		}
+		return walk("")
+	})
+	require.NoError(t, err)
+	return content
+}
+
+func getBackup(t *testing.T, b *boltimore.Boltimore, query string) ([]byte, uint64) {
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup"+query, nil))
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+
+	id, err := strconv.ParseUint(rec.Header().Get("Backup-Id"), 10, 64)
+	require.NoError(t, err)
+
+	return rec.Body.Bytes(), id
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	src := openWithChangeLog(t)
+
+	err := src.DB.Write(func(tx bolted.WriteTx) error {
+		for _, m := range []string{"users", "sessions", "old"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+		for k, v := range map[string]string{"users/1": "john", "users/2": "jane", "sessions/1": "s1", "old/1": "o1"} {
+			err := tx.Put(k, []byte(v))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	full, fullID := getBackup(t, src, "")
+
+	err = src.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.Put("users/1", []byte("johnny"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("users/2")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("old")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("sessions")
+		if err != nil {
+			return err
+		}
+
+		err = tx.CreateMap("sessions")
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("sessions/2", []byte("s2"))
+	})
+	require.NoError(t, err)
+
+	incremental, incrementalID := getBackup(t, src, fmt.Sprintf("?since=%d", fullID))
+	require.True(t, incrementalID > fullID)
+
+	m, err := backup.Verify(bytes.NewReader(incremental))
+	require.NoError(t, err)
+	require.Equal(t, fullID, m.Since)
+	require.Equal(t, incrementalID, m.Sequence)
+
+	expected := dumpContent(t, src)
+
+	t.Run("restoring a chain", func(t *testing.T) {
+		dst := openWithChangeLog(t)
+		err := dst.DB.Write(func(tx bolted.WriteTx) error {
+			return backup.RestoreChain(tx, []io.Reader{bytes.NewReader(full), bytes.NewReader(incremental)}, backup.RestoreOptions{})
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, dumpContent(t, dst))
+	})
+
+	t.Run("restoring a chain with a gap", func(t *testing.T) {
+		_, laterID := getBackup(t, src, "")
+		err := src.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Put("users/3", []byte("jim"))
+		})
+		require.NoError(t, err)
+		later, _ := getBackup(t, src, fmt.Sprintf("?since=%d", laterID))
+
+		dst := openWithChangeLog(t)
+		err = dst.DB.Write(func(tx bolted.WriteTx) error {
+			return backup.RestoreChain(tx, []io.Reader{bytes.NewReader(full), bytes.NewReader(later)}, backup.RestoreOptions{})
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("restoring through the endpoint", func(t *testing.T) {
+		dst := openWithChangeLog(t)
+
+		rec := httptest.NewRecorder()
+		dst.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup", bytes.NewReader(full)))
+		require.Equal(t, 200, rec.Code)
+
+		rec = httptest.NewRecorder()
+		dst.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup", bytes.NewReader(incremental)))
+		require.Equal(t, 422, rec.Code)
+
+		rec = httptest.NewRecorder()
+		dst.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup?mode=merge", bytes.NewReader(incremental)))
+		require.Equal(t, 200, rec.Code)
+
+		require.Equal(t, expected, dumpContent(t, dst))
+	})
+
+	t.Run("unknown backup", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		src.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?since=1000", nil))
+		require.Equal(t, 404, rec.Code)
+
+		rec = httptest.NewRecorder()
+		src.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?since=foo", nil))
+		require.Equal(t, 400, rec.Code)
+	})
+
+	t.Run("pruned change log", func(t *testing.T) {
+		err := src.DB.Write(func(tx bolted.WriteTx) error {
+			return backup.PruneChangeLog(tx, incrementalID)
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		src.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/backup?since=%d", fullID), nil))
+		require.Equal(t, 404, rec.Code)
+
+		getBackup(t, src, fmt.Sprintf("?since=%d", incrementalID))
+	})
+}
+
+func TestIncrementalBackupAfterReplaceRestore(t *testing.T) {
+	src := openWithChangeLog(t)
+
+	put := func(k, v string) {
+		err := src.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Put(k, []byte(v))
+		})
+		require.NoError(t, err)
+	}
+
+	put("kept", "1")
+	old, _ := getBackup(t, src, "")
+
+	put("removed", "2")
+	full, fullID := getBackup(t, src, "")
+
+	// the replace restore deletes the value written after the old backup
+	rec := httptest.NewRecorder()
+	src.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup", bytes.NewReader(old)))
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+
+	incremental, _ := getBackup(t, src, fmt.Sprintf("?since=%d", fullID))
+
+	dst := openWithChangeLog(t)
+	err := dst.DB.Write(func(tx bolted.WriteTx) error {
+		return backup.RestoreChain(tx, []io.Reader{bytes.NewReader(full), bytes.NewReader(incremental)}, backup.RestoreOptions{})
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{"/kept": "1"}, dumpContent(t, dst))
+	require.Equal(t, dumpContent(t, src), dumpContent(t, dst))
+}
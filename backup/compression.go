@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	compressionParameter = "compression"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// negotiateCompression selects the compression of a backup download.
+// The compression query parameter takes precedence over the Accept-Encoding
+// header. contentEncoding is true when the choice was made from the header,
+// meaning that the response should carry a Content-Encoding header.
+func negotiateCompression(r *http.Request) (compression string, contentEncoding bool, err error) {
+	c := r.URL.Query().Get(compressionParameter)
+	switch c {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return c, false, nil
+	case "":
+	default:
+		return "", false, errors.Errorf("unsupported compression %q", c)
+	}
+
+	best := CompressionNone
+	bestQ := 0.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				q, err = strconv.ParseFloat(f[2:], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+
+		if coding != CompressionGzip && coding != CompressionZstd {
+			continue
+		}
+
+		// zstd is preferred when both are equally acceptable
+		if q > bestQ || (q == bestQ && q > 0 && coding == CompressionZstd) {
+			best = coding
+			bestQ = q
+		}
+	}
+
+	return best, best != CompressionNone, nil
+}
+
+func compressionContentType(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return "application/gzip"
+	case CompressionZstd:
+		return "application/zstd"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressingWriter returns a writer compressing into w.
+// Closing it flushes the compressed stream, but does not close w.
+func compressingWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone, "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, errors.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// decompressingReader returns a reader decompressing r.
+// When contentEncoding is empty, the compression is detected from the magic
+// bytes at the beginning of the stream.
+func decompressingReader(r io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case CompressionGzip, "x-gzip":
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		return newZstdReader(r)
+	case "identity":
+		return ioutil.NopCloser(r), nil
+	case "":
+	default:
+		return nil, errors.Errorf("unsupported content encoding %q", contentEncoding)
+	}
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(encryptionMagic))
+
+	switch {
+	case isEncrypted(head):
+		return nil, ErrEncrypted
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, zstdMagic):
+		return newZstdReader(br)
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zstdReadCloser{d}, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
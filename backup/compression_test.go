@@ -0,0 +1,110 @@
+package backup_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedBackupAndRestore(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+	)
+	require.NoError(t, err)
+
+	defer b.Close()
+
+	large := make([]byte, 100000)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err = tx.CreateMap("foo")
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("foo/bar", large)
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name                    string
+		url                     string
+		acceptEncoding          string
+		expectedContentEncoding string
+		expectedContentType     string
+		expectedMagic           []byte
+	}{
+		{"no compression", "/backup", "", "", "application/octet-stream", []byte{1}},
+		{"gzip by header", "/backup", "gzip", "gzip", "application/octet-stream", []byte{0x1f, 0x8b}},
+		{"zstd by header", "/backup", "gzip, zstd", "zstd", "application/octet-stream", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+		{"header with quality", "/backup", "gzip;q=1, zstd;q=0.5", "gzip", "application/octet-stream", []byte{0x1f, 0x8b}},
+		{"unsupported encoding", "/backup", "br", "", "application/octet-stream", []byte{1}},
+		{"gzip by parameter", "/backup?compression=gzip", "zstd", "", "application/gzip", []byte{0x1f, 0x8b}},
+		{"zstd by parameter", "/backup?compression=zstd", "", "", "application/zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+		{"none by parameter", "/backup?compression=none", "gzip", "", "application/octet-stream", []byte{1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", c.url, nil)
+			if c.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", c.acceptEncoding)
+			}
+
+			rec := httptest.NewRecorder()
+			b.ServeHTTP(rec, req)
+			require.Equal(t, 200, rec.Code)
+			require.Equal(t, c.expectedContentEncoding, rec.Header().Get("Content-Encoding"))
+			require.Equal(t, c.expectedContentType, rec.Header().Get("Content-Type"))
+
+			bk := rec.Body.Bytes()
+			require.True(t, bytes.HasPrefix(bk, c.expectedMagic))
+
+			err = b.DB.Write(func(tx bolted.WriteTx) error {
+				return tx.Delete("foo")
+			})
+			require.NoError(t, err)
+
+			req = httptest.NewRequest("PUT", "/backup", bytes.NewReader(bk))
+			if c.expectedContentEncoding != "" {
+				req.Header.Set("Content-Encoding", c.expectedContentEncoding)
+			}
+
+			rec = httptest.NewRecorder()
+			b.ServeHTTP(rec, req)
+			require.Equal(t, 200, rec.Code)
+
+			err = b.DB.Read(func(tx bolted.ReadTx) error {
+				v, err := tx.Get("foo/bar")
+				require.NoError(t, err)
+				require.Equal(t, large, v)
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("unsupported compression parameter", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?compression=lz4", nil))
+		require.Equal(t, 400, rec.Code)
+	})
+
+	t.Run("unsupported content encoding", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/backup", bytes.NewReader(nil))
+		req.Header.Set("Content-Encoding", "br")
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		require.Equal(t, 415, rec.Code)
+	})
+}
@@ -0,0 +1,39 @@
+package backup
+
+import "github.com/draganm/boltimore/clock"
+
+// Option configures encryption and compression of dumps.
+type Option func(c *config)
+
+type config struct {
+	key         []byte
+	keyFile     string
+	passphrase  string
+	compression string
+	snapshots   *snapshotStore
+	clock       clock.Clock
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{clock: clock.New()}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// WithClock replaces the wall clock used for the times reported by the
+// staged restore endpoints.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = c
+	}
+}
+
+// WithCompression compresses backup files written by WriteBackupFile and
+// Scheduled with CompressionGzip or CompressionZstd.
+func WithCompression(compression string) Option {
+	return func(c *config) {
+		c.compression = compression
+	}
+}
@@ -0,0 +1,332 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dump"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+const (
+	diffFromPart = "from"
+	diffToPart   = "to"
+)
+
+type DiffOptions struct {
+	// Prefix is the map to compare, empty for the whole database.
+	Prefix string
+	// AllowUnverified permits comparing dumps without a manifest.
+	AllowUnverified bool
+}
+
+// DiffEntry is a value or a map that differs.
+type DiffEntry struct {
+	Path string `json:"path"`
+	Map  bool   `json:"map"`
+}
+
+// DiffReport lists the paths added, removed and changed between two states
+// of the database. Values are changed when their content differs, paths are
+// changed when they are a map in one state and a value in the other, Map
+// refers to the newer state then. The contents of added and removed maps
+// are listed as well.
+type DiffReport struct {
+	Added   []DiffEntry `json:"added"`
+	Removed []DiffEntry `json:"removed"`
+	Changed []DiffEntry `json:"changed"`
+}
+
+// diffValue is the digest of a value, or marks a map.
+type diffValue struct {
+	isMap  bool
+	digest [sha256.Size]byte
+}
+
+type diffState map[string]diffValue
+
+// Diff compares the map at the prefix in two full dumps.
+// Compressed dumps are detected, incremental dumps can't be compared.
+func Diff(from, to io.Reader, opts DiffOptions) (*DiffReport, error) {
+	fromState, err := readDiffState(from, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading first dump")
+	}
+
+	toState, err := readDiffState(to, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading second dump")
+	}
+
+	return compareDiffStates(fromState, toState), nil
+}
+
+// DiffLive compares the map at the prefix in a full dump with the database.
+func DiffLive(tx bolted.ReadTx, from io.Reader, opts DiffOptions) (*DiffReport, error) {
+	fromState, err := readDiffState(from, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	toState, err := liveDiffState(tx, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return compareDiffStates(fromState, toState), nil
+}
+
+func readDiffState(r io.Reader, opts DiffOptions) (diffState, error) {
+	prefix, err := paths.Normalize(opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	dr, err := decompressingReader(r, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening compressed dump")
+	}
+	defer dr.Close()
+
+	state := diffState{}
+	tr := newDumpReader(dr)
+
+	for {
+		nx, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, invalidDump{errors.Wrap(err, "while reading next dump entry")}
+		}
+
+		key, err := paths.Normalize(nx.Key)
+		if err != nil {
+			return nil, invalidDump{err}
+		}
+
+		if key == prefix || !isWithin(key, prefix) || isExcluded(key) {
+			continue
+		}
+
+		switch nx.Type {
+		case dump.CreateMap:
+			state[key] = diffValue{isMap: true}
+		case dump.Put:
+			state[key] = diffValue{digest: sha256.Sum256(nx.Value)}
+		case Deletion:
+			return nil, invalidDump{errors.New("incremental dumps can't be compared")}
+		default:
+			return nil, invalidDump{errors.Errorf("unsupported type %d", nx.Type)}
+		}
+	}
+
+	m := tr.Manifest()
+	if m == nil && !opts.AllowUnverified {
+		return nil, invalidDump{ErrUnverified}
+	}
+
+	return state, nil
+}
+
+func liveDiffState(tx bolted.ReadTx, prefix string) (diffState, error) {
+	prefix, err := paths.Normalize(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	state := diffState{}
+
+	found, err := paths.IsMap(tx, prefix)
+	if err != nil || !found {
+		return state, err
+	}
+
+	err = walk(tx, prefix, func(pth string, value []byte) error {
+		if isExcluded(pth) {
+			return errSkipMap
+		}
+
+		if pth == prefix {
+			return nil
+		}
+
+		if value == nil {
+			state[pth] = diffValue{isMap: true}
+			return nil
+		}
+
+		state[pth] = diffValue{digest: sha256.Sum256(value)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func compareDiffStates(from, to diffState) *DiffReport {
+	report := &DiffReport{
+		Added:   []DiffEntry{},
+		Removed: []DiffEntry{},
+		Changed: []DiffEntry{},
+	}
+
+	for pth, v := range from {
+		nv, found := to[pth]
+		switch {
+		case !found:
+			report.Removed = append(report.Removed, DiffEntry{Path: pth, Map: v.isMap})
+		case nv != v:
+			report.Changed = append(report.Changed, DiffEntry{Path: pth, Map: nv.isMap})
+		}
+	}
+
+	for pth, v := range to {
+		if _, found := from[pth]; !found {
+			report.Added = append(report.Added, DiffEntry{Path: pth, Map: v.isMap})
+		}
+	}
+
+	for _, l := range [][]DiffEntry{report.Added, report.Removed, report.Changed} {
+		sortDiffEntries(l)
+	}
+
+	return report
+}
+
+func sortDiffEntries(l []DiffEntry) {
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Path < l[j].Path
+	})
+}
+
+// DiffEndpoint compares the dump in the request body with the database.
+// When the request is a multipart/form-data request, the dumps in the parts
+// named from and to are compared instead.
+func DiffEndpoint(rc *boltimore.RequestContext) error {
+	return newConfig(nil).diffEndpoint(rc)
+}
+
+// NewDiffEndpoint returns DiffEndpoint decrypting dumps with the configured key.
+func NewDiffEndpoint(opts ...Option) func(rc *boltimore.RequestContext) error {
+	return newConfig(opts).diffEndpoint
+}
+
+func (c *config) diffEndpoint(rc *boltimore.RequestContext) (err error) {
+	defer func() {
+		if err != nil {
+			rc.Logger.With("error", err).Info("while comparing backups")
+		}
+	}()
+
+	query := rc.Request.URL.Query()
+	opts := DiffOptions{
+		Prefix:          query.Get(prefixParameter),
+		AllowUnverified: query.Get(allowUnverifiedParameter) == "true",
+	}
+
+	var report *DiffReport
+
+	mediaType, _, _ := mime.ParseMediaType(rc.Request.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		report, err = c.diffParts(rc, opts)
+	} else {
+		report, err = c.diffLive(rc, opts)
+	}
+
+	if errors.Cause(err) == errUnsupportedDump {
+		return rc.RespondWithError(err.Error(), 415)
+	}
+
+	if isInvalidDump(errors.Cause(err)) {
+		return rc.RespondWithError(err.Error(), 422)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithJSON(report)
+}
+
+// errUnsupportedDump marks dumps which can't be decoded or decrypted.
+var errUnsupportedDump = errors.New("unsupported dump")
+
+func (c *config) readDiffState(r io.Reader, contentEncoding string, opts DiffOptions) (diffState, error) {
+	body, err := c.openDump(r, contentEncoding)
+	if isInvalidDump(err) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(errUnsupportedDump, err.Error())
+	}
+	defer body.Close()
+
+	return readDiffState(body, opts)
+}
+
+func (c *config) diffLive(rc *boltimore.RequestContext, opts DiffOptions) (*DiffReport, error) {
+	from, err := c.readDiffState(rc.Request.Body, rc.Request.Header.Get("Content-Encoding"), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var to diffState
+	err = rc.DB.Read(func(tx bolted.ReadTx) (err error) {
+		to, err = liveDiffState(tx, opts.Prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return compareDiffStates(from, to), nil
+}
+
+func (c *config) diffParts(rc *boltimore.RequestContext, opts DiffOptions) (*DiffReport, error) {
+	mr, err := rc.Request.MultipartReader()
+	if err != nil {
+		return nil, invalidDump{err}
+	}
+
+	states := map[string]diffState{}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, invalidDump{errors.Wrap(err, "while reading multipart request")}
+		}
+
+		name := part.FormName()
+		if name != diffFromPart && name != diffToPart {
+			continue
+		}
+
+		states[name], err = c.readDiffState(part, part.Header.Get("Content-Encoding"), opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading %s", name)
+		}
+	}
+
+	for _, name := range []string{diffFromPart, diffToPart} {
+		if states[name] == nil {
+			return nil, invalidDump{errors.Errorf("missing part %s", name)}
+		}
+	}
+
+	return compareDiffStates(states[diffFromPart], states[diffToPart]), nil
+}
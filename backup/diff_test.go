@@ -0,0 +1,183 @@
+package backup_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("POST", "/diff", backup.DiffEndpoint),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	dumpDB := func() []byte {
+		buf := new(bytes.Buffer)
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			return backup.Backup(tx, "", buf)
+		})
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		for _, m := range []string{"users", "users/alice", "users/bob", "old"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+		for k, v := range map[string]string{
+			"users/alice/name": "Alice",
+			"users/bob/name":   "Bob",
+			"old/value":        "x",
+			"kind":             "value",
+		} {
+			err := tx.Put(k, []byte(v))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	before := dumpDB()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.Put("users/alice/name", []byte("Alice Smith"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("old")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("kind")
+		if err != nil {
+			return err
+		}
+
+		err = tx.CreateMap("kind")
+		if err != nil {
+			return err
+		}
+
+		err = tx.CreateMap("users/carol")
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("users/carol/name", []byte("Carol"))
+	})
+	require.NoError(t, err)
+
+	expected := &backup.DiffReport{
+		Added: []backup.DiffEntry{
+			{Path: "users/carol", Map: true},
+			{Path: "users/carol/name"},
+		},
+		Removed: []backup.DiffEntry{
+			{Path: "old", Map: true},
+			{Path: "old/value"},
+		},
+		Changed: []backup.DiffEntry{
+			{Path: "kind", Map: true},
+			{Path: "users/alice/name"},
+		},
+	}
+
+	t.Run("two dumps", func(t *testing.T) {
+		report, err := backup.Diff(bytes.NewReader(before), bytes.NewReader(dumpDB()), backup.DiffOptions{})
+		require.NoError(t, err)
+		require.Equal(t, expected, report)
+	})
+
+	t.Run("dump and live database", func(t *testing.T) {
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			report, err := backup.DiffLive(tx, bytes.NewReader(before), backup.DiffOptions{})
+			require.NoError(t, err)
+			require.Equal(t, expected, report)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		report, err := backup.Diff(bytes.NewReader(before), bytes.NewReader(dumpDB()), backup.DiffOptions{Prefix: "users/alice"})
+		require.NoError(t, err)
+		require.Equal(t, &backup.DiffReport{
+			Added:   []backup.DiffEntry{},
+			Removed: []backup.DiffEntry{},
+			Changed: []backup.DiffEntry{{Path: "users/alice/name"}},
+		}, report)
+	})
+
+	t.Run("endpoint with live database", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/diff", bytes.NewReader(before)))
+		require.Equal(t, 200, rec.Code)
+
+		report := &backup.DiffReport{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), report))
+		require.Equal(t, expected, report)
+	})
+
+	t.Run("endpoint with two dumps", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		for name, d := range map[string][]byte{"from": before, "to": dumpDB()} {
+			pw, err := mw.CreateFormFile(name, name+".dump")
+			require.NoError(t, err)
+			_, err = pw.Write(d)
+			require.NoError(t, err)
+		}
+		require.NoError(t, mw.Close())
+
+		req := httptest.NewRequest("POST", "/diff", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		require.Equal(t, 200, rec.Code)
+
+		report := &backup.DiffReport{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), report))
+		require.Equal(t, expected, report)
+	})
+
+	t.Run("endpoint with a missing part", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		pw, err := mw.CreateFormFile("from", "from.dump")
+		require.NoError(t, err)
+		_, err = pw.Write(before)
+		require.NoError(t, err)
+		require.NoError(t, mw.Close())
+
+		req := httptest.NewRequest("POST", "/diff", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		require.Equal(t, 422, rec.Code)
+	})
+
+	t.Run("endpoint with a corrupt dump", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/diff", bytes.NewReader(before[:len(before)-5])))
+		require.Equal(t, 422, rec.Code)
+	})
+}
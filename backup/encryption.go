@@ -0,0 +1,329 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted dumps start with a header followed by a sequence of AES-256-GCM
+// sealed chunks of encryptionChunkSize bytes of plaintext each.
+// The nonce of each chunk is the random nonce prefix from the header, the
+// chunk counter and a flag marking the last chunk, so reordered, dropped or
+// truncated chunks fail to decrypt. The header is authenticated as additional
+// data of every chunk.
+//
+// header: magic (8) | kdf (1) | salt (16) | nonce prefix (7)
+var encryptionMagic = []byte("BTMRENC1")
+
+const (
+	kdfKey        byte = 0
+	kdfPassphrase byte = 1
+
+	saltSize            = 16
+	noncePrefixSize     = 7
+	headerSize          = 8 + 1 + saltSize + noncePrefixSize
+	keySize             = 32
+	encryptionChunkSize = 64 * 1024
+)
+
+var ErrEncrypted = errors.New("dump is encrypted, but no key is configured")
+
+// WithKey encrypts dumps with a 32 byte AES-256 key.
+func WithKey(key []byte) Option {
+	return func(c *config) {
+		c.key = key
+	}
+}
+
+// WithKeyFile encrypts dumps with the key read from the file on each use.
+// The file contains either 32 raw bytes or the key encoded as hex or base64.
+func WithKeyFile(fileName string) Option {
+	return func(c *config) {
+		c.keyFile = fileName
+	}
+}
+
+// WithPassphrase encrypts dumps with a key derived from the passphrase using scrypt.
+func WithPassphrase(passphrase string) Option {
+	return func(c *config) {
+		c.passphrase = passphrase
+	}
+}
+
+func (c *config) encrypted() bool {
+	return c.key != nil || c.keyFile != "" || c.passphrase != ""
+}
+
+// deriveKey returns the key for the kdf and salt from the header.
+func (c *config) deriveKey(kdf byte, salt []byte) ([]byte, error) {
+	switch kdf {
+	case kdfPassphrase:
+		if c.passphrase == "" {
+			return nil, errors.New("dump is encrypted with a passphrase, but none is configured")
+		}
+		return scrypt.Key([]byte(c.passphrase), salt, 1<<15, 8, 1, keySize)
+	case kdfKey:
+		key := c.key
+		if c.keyFile != "" {
+			var err error
+			key, err = readKeyFile(c.keyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if key == nil {
+			return nil, errors.New("dump is encrypted with a key, but none is configured")
+		}
+
+		if len(key) != keySize {
+			return nil, errors.Errorf("key must be %d bytes long, got %d", keySize, len(key))
+		}
+
+		return key, nil
+	default:
+		return nil, errors.Errorf("unsupported key derivation %d", kdf)
+	}
+}
+
+func readKeyFile(fileName string) ([]byte, error) {
+	d, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading key file")
+	}
+
+	if len(d) == keySize {
+		return d, nil
+	}
+
+	text := string(bytes.TrimSpace(d))
+
+	key, err := hex.DecodeString(text)
+	if err == nil && len(key) == keySize {
+		return key, nil
+	}
+
+	key, err = base64.StdEncoding.DecodeString(text)
+	if err == nil && len(key) == keySize {
+		return key, nil
+	}
+
+	return nil, errors.Errorf("key file %s does not contain a %d byte key", fileName, keySize)
+}
+
+// EncryptingWriter returns a writer encrypting into w with the configured key.
+// Close must be called to write the last chunk, it does not close w.
+func EncryptingWriter(w io.Writer, opts ...Option) (io.WriteCloser, error) {
+	return newConfig(opts).encryptingWriter(w)
+}
+
+func (c *config) encryptingWriter(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, headerSize)
+	copy(header, encryptionMagic)
+
+	salt := header[9 : 9+saltSize]
+	_, err := rand.Read(header[9:])
+	if err != nil {
+		return nil, err
+	}
+
+	if c.passphrase != "" {
+		header[8] = kdfPassphrase
+	} else {
+		header[8] = kdfKey
+		for i := range salt {
+			salt[i] = 0
+		}
+	}
+
+	key, err := c.deriveKey(header[8], salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint32
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, the last chunk
+		// has to be sealed by Close
+		if len(e.buf) == encryptionChunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("too many chunks")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.header, e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(header []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[headerSize-noncePrefixSize:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func isEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, encryptionMagic)
+}
+
+// DecryptingReader returns a reader decrypting r with the configured key.
+// Unencrypted input is returned unchanged.
+func DecryptingReader(r io.Reader, opts ...Option) (io.Reader, error) {
+	return newConfig(opts).decryptingReader(r)
+}
+
+func (c *config) decryptingReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(encryptionMagic))
+	if !isEncrypted(head) {
+		return br, nil
+	}
+
+	if !c.encrypted() {
+		return nil, ErrEncrypted
+	}
+
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "while reading encryption header")
+	}
+
+	key, err := c.deriveKey(header[8], header[9:9+saltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		r:      br,
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+type decryptingReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	chunk   []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		err := d.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	switch err {
+	case nil:
+		// a full chunk is the last one when nothing follows it
+		_, err = d.r.Peek(1)
+		d.done = err == io.EOF
+	case io.ErrUnexpectedEOF:
+		d.done = true
+	case io.EOF:
+		return errors.Wrap(io.ErrUnexpectedEOF, "encrypted dump is truncated")
+	default:
+		return err
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.header, d.counter, d.done), d.chunk[:n], d.header)
+	if err != nil {
+		return errors.Wrap(err, "while decrypting dump")
+	}
+
+	d.counter++
+	d.plain = plain
+	return nil
+}
@@ -0,0 +1,177 @@
+package backup_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedBackupAndRestore(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err = ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	require.NoError(t, err)
+
+	otherKey := make([]byte, 32)
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/backup", backup.NewBackupEndpoint(backup.WithKey(key))),
+		boltimore.Endpoint("PUT", "/backup", backup.NewRestoreEndpoint(backup.WithKeyFile(keyFile))),
+		boltimore.Endpoint("POST", "/backup/verify", backup.NewVerifyEndpoint(backup.WithKey(key))),
+		boltimore.Endpoint("GET", "/backup/passphrase", backup.NewBackupEndpoint(backup.WithPassphrase("secret"))),
+		boltimore.Endpoint("PUT", "/backup/passphrase", backup.NewRestoreEndpoint(backup.WithPassphrase("secret"))),
+		boltimore.Endpoint("PUT", "/backup/plain", backup.RestoreEndpoint),
+		boltimore.Endpoint("PUT", "/backup/other", backup.NewRestoreEndpoint(backup.WithKey(otherKey))),
+	)
+	require.NoError(t, err)
+
+	defer b.Close()
+
+	secret := bytes.Repeat([]byte("customer data "), 20000)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return tx.Put("secret", secret)
+	})
+	require.NoError(t, err)
+
+	download := func(t *testing.T, url, acceptEncoding string) []byte {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+		bk := rec.Body.Bytes()
+		require.True(t, bytes.HasPrefix(bk, []byte("BTMRENC1")))
+		require.False(t, bytes.Contains(bk, []byte("customer data")))
+		return bk
+	}
+
+	upload := func(t *testing.T, url string, d []byte) int {
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Put("secret", []byte("overwritten"))
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", url, bytes.NewReader(d)))
+		return rec.Code
+	}
+
+	requireRestored := func(t *testing.T) {
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			v, err := tx.Get("secret")
+			require.NoError(t, err)
+			require.Equal(t, secret, v)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	bk := download(t, "/backup", "")
+
+	t.Run("key", func(t *testing.T) {
+		for _, enc := range []string{"", "gzip", "zstd"} {
+			bk := download(t, "/backup", enc)
+
+			rec := httptest.NewRecorder()
+			b.ServeHTTP(rec, httptest.NewRequest("POST", "/backup/verify", bytes.NewReader(bk)))
+			require.Equal(t, 200, rec.Code)
+
+			require.Equal(t, 200, upload(t, "/backup", bk))
+			requireRestored(t)
+		}
+	})
+
+	t.Run("passphrase", func(t *testing.T) {
+		bk := download(t, "/backup/passphrase?compression=gzip", "")
+		require.Equal(t, 200, upload(t, "/backup/passphrase", bk))
+		requireRestored(t)
+
+		require.Equal(t, 422, upload(t, "/backup", bk))
+	})
+
+	t.Run("restore without key", func(t *testing.T) {
+		require.Equal(t, 422, upload(t, "/backup/plain", bk))
+	})
+
+	t.Run("restore with wrong key", func(t *testing.T) {
+		require.Equal(t, 422, upload(t, "/backup/other", bk))
+	})
+
+	t.Run("truncated or tampered backup", func(t *testing.T) {
+
+		require.Equal(t, 422, upload(t, "/backup", bk[:len(bk)-1]))
+		require.Equal(t, 422, upload(t, "/backup", bk[:64*1024+16+32]))
+
+		tampered := append([]byte{}, bk...)
+		tampered[100] ^= 0x01
+		require.Equal(t, 422, upload(t, "/backup", tampered))
+	})
+
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+
+	for _, size := range []int{0, 1, 64*1024 - 1, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024} {
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		require.NoError(t, err)
+
+		encrypted := new(bytes.Buffer)
+		w, err := backup.EncryptingWriter(encrypted, backup.WithKey(key))
+		require.NoError(t, err)
+
+		_, err = w.Write(plain)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r, err := backup.DecryptingReader(encrypted, backup.WithKey(key))
+		require.NoError(t, err)
+
+		decrypted, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, plain, decrypted, "size %d", size)
+	}
+}
+
+func TestEncryptedBackupFile(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return tx.Put("foo", []byte("bar"))
+	})
+	require.NoError(t, err)
+
+	fileName, err := backup.WriteBackupFile(b.DB, t.TempDir(), time.Now(), backup.WithPassphrase("secret"), backup.WithCompression(backup.CompressionZstd))
+	require.NoError(t, err)
+
+	f, err := os.Open(fileName)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := backup.DecryptingReader(f, backup.WithPassphrase("secret"))
+	require.NoError(t, err)
+
+	m, err := backup.Verify(r)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), m.Values)
+}
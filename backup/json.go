@@ -0,0 +1,144 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/fixtures"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// JSONExportEndpoint responds with the map at the prefix query parameter as
+// nested JSON objects. Values are exported as strings when they are valid
+// UTF-8 and as {"$base64": "..."} otherwise, see the fixtures package.
+func JSONExportEndpoint(rc *boltimore.RequestContext) error {
+	prefix, err := paths.Normalize(rc.Request.URL.Query().Get(prefixParameter))
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	var tree map[string]interface{}
+	err = rc.DB.Read(func(tx bolted.ReadTx) error {
+		found, err := paths.IsMap(tx, prefix)
+		if err != nil || !found {
+			return err
+		}
+
+		tree, err = fixtures.ExportTree(tx, prefix)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if tree == nil {
+		return rc.RespondWithError("map not found", 404)
+	}
+
+	if prefix == "" {
+		for name := range tree {
+			if isInternal(dbpath.Join(name)) {
+				delete(tree, name)
+			}
+		}
+	}
+
+	rc.ResponseWriter.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rc.ResponseWriter)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tree)
+}
+
+// JSONImportEndpoint writes JSON in the shape returned by JSONExportEndpoint
+// into the map at the prefix query parameter. The map is replaced unless the
+// mode query parameter is merge, which keeps entries missing from the JSON.
+// Internal maps such as the change log or job queues can't be imported and
+// are kept when the whole database is replaced.
+func JSONImportEndpoint(rc *boltimore.RequestContext) error {
+	query := rc.Request.URL.Query()
+
+	prefix, err := paths.Normalize(query.Get(prefixParameter))
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	if prefix != "" && isInternal(prefix) {
+		return rc.RespondWithError(errors.Errorf("%s is an internal map", prefix).Error(), 400)
+	}
+
+	d, err := ioutil.ReadAll(rc.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	if prefix == "" {
+		err = checkNoInternalMaps(d)
+		if err != nil {
+			return rc.RespondWithError(err.Error(), 422)
+		}
+	}
+
+	mode := RestoreMode(query.Get(modeParameter))
+	if mode != "" && mode != RestoreReplace && mode != RestoreMerge {
+		return rc.RespondWithError(errors.Errorf("unsupported import mode %q", mode).Error(), 400)
+	}
+
+	err = rc.DB.Write(func(tx bolted.WriteTx) error {
+		if mode == RestoreMerge {
+			ex, err := paths.IsMap(tx, prefix)
+			if err != nil {
+				return err
+			}
+
+			if !ex {
+				err = tx.CreateMap(prefix)
+				if err != nil {
+					return errors.Wrapf(err, "while creating map %s", prefix)
+				}
+			}
+		} else {
+			err := clear(tx, prefix, isInternal)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := fixtures.Load(tx, prefix, bytes.NewReader(d))
+		if err != nil {
+			return invalidDump{err}
+		}
+
+		return nil
+	})
+
+	if isInvalidDump(err) {
+		return rc.RespondWithError(err.Error(), 422)
+	}
+
+	return err
+}
+
+// checkNoInternalMaps fails when the top level of the JSON contains an
+// internal map.
+func checkNoInternalMaps(d []byte) error {
+	top := map[string]interface{}{}
+	err := yaml.Unmarshal(d, &top)
+	if err != nil {
+		return errors.Wrap(err, "while parsing JSON")
+	}
+
+	for name := range top {
+		if isInternal(dbpath.Join(name)) {
+			return errors.Errorf("%s is an internal map and can't be imported", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package backup_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	_ "github.com/draganm/boltimore/index"
+	"github.com/draganm/boltimore/sequence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONExportAndImport(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/json", backup.JSONExportEndpoint),
+		boltimore.Endpoint("PUT", "/json", backup.JSONImportEndpoint),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		for _, m := range []string{"tenants", "tenants/acme", "tenants/acme/users"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Put("tenants/acme/name", []byte("Acme"))
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("tenants/acme/users/1", []byte{0xff, 0xfe})
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/json?prefix=tenants/acme", nil))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	exported := map[string]interface{}{}
+	err = json.Unmarshal(rec.Body.Bytes(), &exported)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"name": "Acme",
+		"users": map[string]interface{}{
+			"1": map[string]interface{}{"$base64": "//4="},
+		},
+	}, exported)
+
+	get := func(pth string) []byte {
+		var v []byte
+		err := b.DB.Read(func(tx bolted.ReadTx) (err error) {
+			v, err = tx.Get(pth)
+			return err
+		})
+		require.NoError(t, err)
+		return v
+	}
+
+	exists := func(pth string) bool {
+		var ex bool
+		err := b.DB.Read(func(tx bolted.ReadTx) (err error) {
+			ex, err = tx.Exists(pth)
+			return err
+		})
+		require.NoError(t, err)
+		return ex
+	}
+
+	t.Run("replacing", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json?prefix=tenants/acme", strings.NewReader(`{"name": "ACME", "users": {}}`)))
+		require.Equal(t, 200, rec.Code)
+
+		require.Equal(t, "ACME", string(get("tenants/acme/name")))
+		require.False(t, exists("tenants/acme/users/1"))
+	})
+
+	t.Run("merging", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json?prefix=tenants/acme&mode=merge", strings.NewReader(`{"users": {"2": {"$base64": "//4="}}}`)))
+		require.Equal(t, 200, rec.Code)
+
+		require.Equal(t, "ACME", string(get("tenants/acme/name")))
+		require.Equal(t, []byte{0xff, 0xfe}, get("tenants/acme/users/2"))
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json?prefix=tenants/acme", strings.NewReader(`[1, 2]`)))
+		require.Equal(t, 422, rec.Code)
+
+		require.Equal(t, "ACME", string(get("tenants/acme/name")))
+	})
+
+	t.Run("internal maps", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json?mode=merge", strings.NewReader(`{"__changelog": {"sequence": "1"}}`)))
+		require.Equal(t, 422, rec.Code)
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json", strings.NewReader(`{"tenants": {}, "__indexes": {}}`)))
+		require.Equal(t, 422, rec.Code)
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json?prefix=__changelog/log", strings.NewReader(`{}`)))
+		require.Equal(t, 400, rec.Code)
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json", strings.NewReader(`{"tenants": {}, "__sequences": {}}`)))
+		require.Equal(t, 422, rec.Code)
+
+		require.False(t, exists("__changelog"))
+		require.False(t, exists("__indexes"))
+		require.Equal(t, "ACME", string(get("tenants/acme/name")))
+	})
+
+	t.Run("internal maps are kept", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err := sequence.Next(tx, "orders")
+			return err
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/json", nil))
+		require.Equal(t, 200, rec.Code)
+
+		exported := map[string]interface{}{}
+		err = json.Unmarshal(rec.Body.Bytes(), &exported)
+		require.NoError(t, err)
+		require.NotContains(t, exported, "__sequences")
+
+		body := rec.Body.String()
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/json", strings.NewReader(body)))
+		require.Equal(t, 200, rec.Code)
+
+		require.True(t, exists("__sequences/orders"))
+		require.Equal(t, "ACME", string(get("tenants/acme/name")))
+	})
+
+	t.Run("unknown map", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/json?prefix=tenants/foo", nil))
+		require.Equal(t, 404, rec.Code)
+	})
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+
+	"github.com/draganm/bolted/dump"
+	"github.com/pkg/errors"
+)
+
+// Trailer is the item type of the manifest written at the end of each dump.
+// It is not known to dump.Reader, so dumps can only be read by this package.
+const Trailer dump.ItemType = 0x7f
+
+// Manifest describes the content of a dump. It is written as a trailer after
+// the last entry, SHA256 is the digest of all bytes before the trailer.
+// Sequence is the ID of the backup when the change log is enabled, Since
+// is the ID of the backup an incremental dump is based on.
+type Manifest struct {
+	Entries  int64  `json:"entries"`
+	Maps     int64  `json:"maps"`
+	Values   int64  `json:"values"`
+	Deletes  int64  `json:"deletes,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	Since    uint64 `json:"since,omitempty"`
+}
+
+var ErrUnverified = errors.New("dump has no manifest and can't be verified")
+
+// dumpWriter writes dump entries, keeping track of the manifest.
+type dumpWriter struct {
+	w        io.Writer
+	h        hash.Hash
+	mw       io.Writer
+	tw       dump.DumpWriter
+	manifest Manifest
+}
+
+func newDumpWriter(w io.Writer) *dumpWriter {
+	dw := &dumpWriter{
+		w: w,
+		h: sha256.New(),
+	}
+	dw.mw = io.MultiWriter(w, dw.h)
+	dw.tw = dump.NewWriter(dw.mw)
+	return dw
+}
+
+func (dw *dumpWriter) CreateMap(key string) error {
+	n, err := dw.tw.CreateMap(key)
+	if err != nil {
+		return err
+	}
+	dw.manifest.Maps++
+	dw.manifest.Bytes += int64(n)
+	return nil
+}
+
+func (dw *dumpWriter) Put(key string, value []byte) error {
+	n, err := dw.tw.Put(key, value)
+	if err != nil {
+		return err
+	}
+	dw.manifest.Values++
+	dw.manifest.Bytes += int64(n)
+	return nil
+}
+
+// Delete writes a Deletion entry, encoded like a CreateMap entry.
+func (dw *dumpWriter) Delete(key string) error {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(key))
+	buf[0] = byte(Deletion)
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(key)))
+	n += copy(buf[n:], key)
+
+	_, err := dw.mw.Write(buf[:n])
+	if err != nil {
+		return err
+	}
+	dw.manifest.Deletes++
+	dw.manifest.Bytes += int64(n)
+	return nil
+}
+
+// Close writes the trailer, it does not close the underlying writer.
+func (dw *dumpWriter) Close() error {
+	dw.manifest.Entries = dw.manifest.Maps + dw.manifest.Values + dw.manifest.Deletes
+	dw.manifest.SHA256 = hex.EncodeToString(dw.h.Sum(nil))
+
+	d, err := json.Marshal(dw.manifest)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(d))
+	buf[0] = byte(Trailer)
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(d)))
+	n += copy(buf[n:], d)
+
+	_, err = dw.w.Write(buf[:n])
+	return err
+}
+
+// Verify reads the whole dump and checks it against its manifest.
+func Verify(r io.Reader) (*Manifest, error) {
+	dr, err := decompressingReader(r, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening compressed dump")
+	}
+	defer dr.Close()
+
+	tr := newDumpReader(dr)
+	for {
+		_, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := tr.Manifest()
+	if m == nil {
+		return nil, ErrUnverified
+	}
+
+	return m, nil
+}
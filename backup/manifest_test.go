@@ -0,0 +1,151 @@
+package backup_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dump"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+		boltimore.Endpoint("POST", "/backup/verify", backup.VerifyEndpoint),
+	)
+	require.NoError(t, err)
+
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err = tx.CreateMap("foo")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Put("foo/bar", []byte{1, 2, 3})
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("foo/baz", []byte{4, 5, 6})
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+	bk := rec.Body.Bytes()
+
+	type verifyResponse struct {
+		Valid    bool             `json:"valid"`
+		Error    string           `json:"error"`
+		Manifest *backup.Manifest `json:"manifest"`
+	}
+
+	verify := func(t *testing.T, d []byte) (int, verifyResponse) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/backup/verify", bytes.NewReader(d)))
+		vr := verifyResponse{}
+		err := json.Unmarshal(rec.Body.Bytes(), &vr)
+		require.NoError(t, err)
+		return rec.Code, vr
+	}
+
+	restore := func(t *testing.T, url string, d []byte) int {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", url, bytes.NewReader(d)))
+		return rec.Code
+	}
+
+	requireUnchanged := func(t *testing.T) {
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			v, err := tx.Get("foo/baz")
+			require.NoError(t, err)
+			require.Equal(t, []byte{4, 5, 6}, v)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	t.Run("valid backup", func(t *testing.T) {
+		code, vr := verify(t, bk)
+		require.Equal(t, 200, code)
+		require.True(t, vr.Valid)
+		require.Equal(t, int64(3), vr.Manifest.Entries)
+		require.Equal(t, int64(1), vr.Manifest.Maps)
+		require.Equal(t, int64(2), vr.Manifest.Values)
+		require.Len(t, vr.Manifest.SHA256, 64)
+
+		require.Equal(t, 200, restore(t, "/backup", bk))
+		requireUnchanged(t)
+	})
+
+	t.Run("truncated backup", func(t *testing.T) {
+		for _, l := range []int{len(bk) - 1, len(bk) - 30, 12} {
+			truncated := bk[:l]
+
+			code, vr := verify(t, truncated)
+			require.Equal(t, 422, code)
+			require.False(t, vr.Valid)
+
+			require.Equal(t, 422, restore(t, "/backup", truncated))
+			requireUnchanged(t)
+		}
+	})
+
+	t.Run("corrupted backup", func(t *testing.T) {
+		corrupted := append([]byte{}, bk...)
+		// flip a byte in the value of foo/baz
+		corrupted[len("\x01\x03foo\x02\x07foo/bar\x03\x01\x02\x03\x02\x07foo/baz\x03")] ^= 0xff
+
+		code, vr := verify(t, corrupted)
+		require.Equal(t, 422, code)
+		require.False(t, vr.Valid)
+
+		require.Equal(t, 422, restore(t, "/backup", corrupted))
+		requireUnchanged(t)
+	})
+
+	t.Run("hostile lengths", func(t *testing.T) {
+		for _, hostile := range [][]byte{
+			// a value announcing 2^62 bytes
+			[]byte("\x01\x03foo\x02\x07foo/bar\x80\x80\x80\x80\x80\x80\x80\x80\x40"),
+			// a value announcing 1GB that is not there
+			[]byte("\x01\x03foo\x02\x07foo/bar\x80\x80\x80\x80\x04abc"),
+			// a key longer than bbolt allows
+			[]byte("\x01\x80\x80\x04foo"),
+		} {
+			code, vr := verify(t, hostile)
+			require.Equal(t, 422, code)
+			require.False(t, vr.Valid)
+
+			require.Equal(t, 422, restore(t, "/backup", hostile))
+			requireUnchanged(t)
+		}
+	})
+
+	t.Run("backup without manifest", func(t *testing.T) {
+		legacy := new(bytes.Buffer)
+		dw := dump.NewWriter(legacy)
+		_, err = dw.CreateMap("foo")
+		require.NoError(t, err)
+		_, err = dw.Put("foo/baz", []byte{4, 5, 6})
+		require.NoError(t, err)
+
+		code, vr := verify(t, legacy.Bytes())
+		require.Equal(t, 422, code)
+		require.Equal(t, backup.ErrUnverified.Error(), vr.Error)
+
+		require.Equal(t, 422, restore(t, "/backup", legacy.Bytes()))
+		require.Equal(t, 200, restore(t, "/backup?allowUnverified=true", legacy.Bytes()))
+		requireUnchanged(t)
+	})
+}
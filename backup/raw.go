@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"net/http"
+
+	"github.com/draganm/boltimore"
+	"github.com/pkg/errors"
+)
+
+// RawEndpoints adds a GET endpoint at path streaming a snapshot of the bolt
+// database file and a PUT endpoint replacing the database with an uploaded
+// bolt database file. Raw files are neither compressed nor encrypted.
+func RawEndpoints(path string) boltimore.Option {
+	return func(b *boltimore.Boltimore) error {
+		// the endpoints are not added with boltimore.Endpoint, which would
+		// block the database from being replaced
+		b.Router.Methods("GET").Path(path).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			err := b.SnapshotRaw(w)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+			}
+		})
+
+		b.Router.Methods("PUT").Path(path).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := b.RestoreRaw(r.Body)
+			if errors.Cause(err) == boltimore.ErrInvalidDatabaseFile {
+				http.Error(w, err.Error(), 422)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+			}
+		})
+
+		return nil
+	}
+}
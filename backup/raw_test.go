@@ -0,0 +1,135 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawBackupAndRestore(t *testing.T) {
+	starts := make(chan bool, 10)
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		backup.RawEndpoints("/raw"),
+		boltimore.Worker("waiter", func(ctx context.Context, wc *boltimore.WorkerContext) error {
+			starts <- true
+			<-ctx.Done()
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	<-starts
+
+	put := func(value string) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Put("foo", []byte(value))
+		})
+		require.NoError(t, err)
+	}
+
+	get := func() string {
+		var v []byte
+		err := b.DB.Read(func(tx bolted.ReadTx) (err error) {
+			v, err = tx.Get("foo")
+			return err
+		})
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	put("before")
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/raw", nil))
+	require.Equal(t, 200, rec.Code)
+	raw := rec.Body.Bytes()
+
+	put("after")
+
+	t.Run("restoring the snapshot", func(t *testing.T) {
+		db := b.DB
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/raw", bytes.NewReader(raw)))
+		require.Equal(t, 200, rec.Code)
+
+		require.Equal(t, "before", get())
+
+		// handles taken before the restore use the restored database
+		var v []byte
+		err := db.Read(func(tx bolted.ReadTx) (err error) {
+			v, err = tx.Get("foo")
+			return err
+		})
+		require.NoError(t, err)
+		require.Equal(t, "before", string(v))
+
+		// the worker is restarted after the database has been replaced
+		<-starts
+	})
+
+	t.Run("snapshot during a write transaction", func(t *testing.T) {
+		inWrite := make(chan bool)
+		release := make(chan bool)
+		done := make(chan error)
+
+		go func() {
+			done <- b.DB.Write(func(tx bolted.WriteTx) error {
+				err := tx.Put("foo", []byte("during"))
+				if err != nil {
+					return err
+				}
+				inWrite <- true
+				<-release
+				return nil
+			})
+		}()
+
+		<-inWrite
+
+		snapshot := new(bytes.Buffer)
+		snapshotDone := make(chan error)
+		go func() {
+			snapshotDone <- b.SnapshotRaw(snapshot)
+		}()
+
+		select {
+		case <-snapshotDone:
+			require.Fail(t, "snapshot was taken during the write transaction")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(release)
+		require.NoError(t, <-done)
+		require.NoError(t, <-snapshotDone)
+
+		put("before")
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/raw", snapshot))
+		require.Equal(t, 200, rec.Code)
+		<-starts
+
+		// the snapshot contains the write that was in progress
+		require.Equal(t, "during", get())
+		put("before")
+	})
+
+	t.Run("invalid file", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/raw", bytes.NewReader([]byte("not a database"))))
+		require.Equal(t, 422, rec.Code)
+
+		require.Equal(t, "before", get())
+	})
+}
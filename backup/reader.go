@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+
+	"github.com/draganm/bolted/dump"
+	"github.com/pkg/errors"
+)
+
+// Lengths in dumps are not trusted before the manifest has been verified,
+// larger lengths than bbolt can store make the dump invalid.
+const (
+	maxKeySize      = 32768
+	maxValueSize    = 1<<31 - 2
+	maxManifestSize = 1 << 20
+
+	// lengths above are read in chunks, so that a length announcing more
+	// data than the dump contains doesn't allocate it upfront
+	readChunkSize = 64 * 1024
+)
+
+// dumpReader reads entries written by dump.DumpWriter and checks them against
+// the trailing manifest.
+// Unlike dump.Reader it does not return truncated values when the
+// underlying reader returns short reads, as compressed streams do.
+type dumpReader struct {
+	br       *bufio.Reader
+	h        hash.Hash
+	counted  Manifest
+	manifest *Manifest
+}
+
+func newDumpReader(r io.Reader) *dumpReader {
+	return &dumpReader{
+		br: bufio.NewReader(r),
+		h:  sha256.New(),
+	}
+}
+
+// Manifest returns the verified manifest once Next has returned io.EOF.
+// It returns nil for dumps without a manifest.
+func (r *dumpReader) Manifest() *Manifest {
+	return r.manifest
+}
+
+func (r *dumpReader) Next() (dump.Item, error) {
+	if r.manifest != nil {
+		return dump.Item{}, io.EOF
+	}
+
+	tb, err := r.br.ReadByte()
+	if err != nil {
+		return dump.Item{}, err
+	}
+
+	if dump.ItemType(tb) == Trailer {
+		err = r.readTrailer()
+		if err != nil {
+			return dump.Item{}, err
+		}
+		return dump.Item{}, io.EOF
+	}
+
+	r.h.Write([]byte{tb})
+	r.counted.Bytes++
+
+	switch dump.ItemType(tb) {
+	case dump.CreateMap:
+		key, err := r.readData(maxKeySize)
+		if err != nil {
+			return dump.Item{}, unexpectedEOF(err)
+		}
+
+		r.counted.Maps++
+		return dump.Item{Type: dump.CreateMap, Key: string(key)}, nil
+	case Deletion:
+		key, err := r.readData(maxKeySize)
+		if err != nil {
+			return dump.Item{}, unexpectedEOF(err)
+		}
+
+		r.counted.Deletes++
+		return dump.Item{Type: Deletion, Key: string(key)}, nil
+	case dump.Put:
+		key, err := r.readData(maxKeySize)
+		if err != nil {
+			return dump.Item{}, unexpectedEOF(err)
+		}
+
+		value, err := r.readData(maxValueSize)
+		if err != nil {
+			return dump.Item{}, unexpectedEOF(err)
+		}
+
+		r.counted.Values++
+		return dump.Item{Type: dump.Put, Key: string(key), Value: value}, nil
+	default:
+		return dump.Item{}, errors.Errorf("unknown item type %d", tb)
+	}
+}
+
+func (r *dumpReader) readTrailer() error {
+	s, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return errors.Wrap(unexpectedEOF(err), "while reading manifest")
+	}
+
+	d, err := readLength(r.br, s, maxManifestSize)
+	if err != nil {
+		return errors.Wrap(unexpectedEOF(err), "while reading manifest")
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(d, m)
+	if err != nil {
+		return errors.Wrap(err, "while parsing manifest")
+	}
+
+	_, err = r.br.ReadByte()
+	if err != io.EOF {
+		return errors.New("unexpected data after manifest")
+	}
+
+	c := r.counted
+	c.Entries = c.Maps + c.Values + c.Deletes
+	c.SHA256 = hex.EncodeToString(r.h.Sum(nil))
+	c.Sequence = m.Sequence
+	c.Since = m.Since
+
+	if *m != c {
+		return errors.Errorf("dump does not match its manifest: expected %d maps, %d values, %d bytes, digest %s; got %d maps, %d values, %d bytes, digest %s", m.Maps, m.Values, m.Bytes, m.SHA256, c.Maps, c.Values, c.Bytes, c.SHA256)
+	}
+
+	r.manifest = m
+	return nil
+}
+
+func (r *dumpReader) readData(max uint64) ([]byte, error) {
+	s, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, s)
+	r.h.Write(buf[:n])
+
+	d, err := readLength(r.br, s, max)
+	if err != nil {
+		return nil, err
+	}
+
+	r.h.Write(d)
+	r.counted.Bytes += int64(n) + int64(len(d))
+
+	return d, nil
+}
+
+// readLength reads s bytes, failing with invalidDump when s exceeds max.
+func readLength(r io.Reader, s, max uint64) ([]byte, error) {
+	if s > max {
+		return nil, invalidDump{errors.Errorf("length %d exceeds the maximum of %d", s, max)}
+	}
+
+	if s <= readChunkSize {
+		d := make([]byte, int(s))
+		_, err := io.ReadFull(r, d)
+		return d, err
+	}
+
+	d := make([]byte, 0, readChunkSize)
+	for uint64(len(d)) < s {
+		chunk := s - uint64(len(d))
+		if chunk > readChunkSize {
+			chunk = readChunkSize
+		}
+
+		d = append(d, make([]byte, int(chunk))...)
+		_, err := io.ReadFull(r, d[len(d)-int(chunk):])
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// unexpectedEOF turns io.EOF in the middle of an entry into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package backup_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreModes(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	put := func(values map[string]string) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			ex, err := tx.Exists("data")
+			if err != nil {
+				return err
+			}
+			if ex {
+				err = tx.Delete("data")
+				if err != nil {
+					return err
+				}
+			}
+			err = tx.CreateMap("data")
+			if err != nil {
+				return err
+			}
+			for k, v := range values {
+				err = tx.Put("data/"+k, []byte(v))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	content := func() map[string]string {
+		values := map[string]string{}
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			it, err := tx.Iterator("data")
+			if err != nil {
+				return err
+			}
+			for ; !it.Done; it.Next() {
+				values[it.Key] = string(it.Value)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return values
+	}
+
+	put(map[string]string{"a": "1", "b": "2"})
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+	bk := rec.Body.Bytes()
+
+	current := map[string]string{"b": "3", "c": "4"}
+
+	restore := func(query string) *httptest.ResponseRecorder {
+		put(current)
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup"+query, bytes.NewReader(bk)))
+		return rec
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		rec := restore("?mode=replace")
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, map[string]string{"a": "1", "b": "2"}, content())
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		rec := restore("?mode=merge")
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, map[string]string{"a": "1", "b": "2", "c": "4"}, content())
+	})
+
+	t.Run("skip existing", func(t *testing.T) {
+		rec := restore("?mode=skip-existing")
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, map[string]string{"a": "1", "b": "3", "c": "4"}, content())
+	})
+
+	t.Run("unsupported mode", func(t *testing.T) {
+		rec := restore("?mode=foo")
+		require.Equal(t, 400, rec.Code)
+		require.Equal(t, current, content())
+	})
+
+	dryRun := func(t *testing.T, mode string) backup.RestoreReport {
+		rec := restore("?dryRun=true&mode=" + mode)
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, current, content())
+
+		report := backup.RestoreReport{}
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		require.NoError(t, err)
+		return report
+	}
+
+	t.Run("dry run replace", func(t *testing.T) {
+		require.Equal(t, backup.RestoreReport{
+			Mode:        backup.RestoreReplace,
+			Created:     []string{"data/a"},
+			Overwritten: []string{"data/b"},
+			Deleted:     []string{"data/c"},
+			Skipped:     []string{},
+		}, dryRun(t, ""))
+	})
+
+	t.Run("dry run merge", func(t *testing.T) {
+		require.Equal(t, backup.RestoreReport{
+			Mode:        backup.RestoreMerge,
+			Created:     []string{"data/a"},
+			Overwritten: []string{"data/b"},
+			Deleted:     []string{},
+			Skipped:     []string{},
+		}, dryRun(t, "merge"))
+	})
+
+	t.Run("dry run skip existing", func(t *testing.T) {
+		require.Equal(t, backup.RestoreReport{
+			Mode:        backup.RestoreSkipExisting,
+			Created:     []string{"data/a"},
+			Overwritten: []string{},
+			Deleted:     []string{},
+			Skipped:     []string{"data/b"},
+		}, dryRun(t, "skip-existing"))
+	})
+}
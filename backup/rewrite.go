@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+const (
+	rewriteFromParameter = "rewriteFrom"
+	rewriteToParameter   = "rewriteTo"
+)
+
+// Rewrite moves the map From and everything below it to To when restoring.
+type Rewrite struct {
+	From string
+	To   string
+}
+
+// rewritesFromQuery pairs repeated rewriteFrom and rewriteTo parameters by their order.
+func rewritesFromQuery(query url.Values) ([]Rewrite, error) {
+	from := query[rewriteFromParameter]
+	to := query[rewriteToParameter]
+
+	if len(from) != len(to) {
+		return nil, errors.Errorf("got %d %s and %d %s parameters", len(from), rewriteFromParameter, len(to), rewriteToParameter)
+	}
+
+	rewrites := make([]Rewrite, len(from))
+	for i := range from {
+		rewrites[i] = Rewrite{From: from[i], To: to[i]}
+	}
+
+	return normalizeRewrites(rewrites)
+}
+
+func normalizeRewrites(rewrites []Rewrite) ([]Rewrite, error) {
+	normalized := make([]Rewrite, len(rewrites))
+	for i, rw := range rewrites {
+		from, err := paths.Normalize(rw.From)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing rewrite source %q", rw.From)
+		}
+
+		to, err := paths.Normalize(rw.To)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing rewrite target %q", rw.To)
+		}
+
+		if from == "" || to == "" {
+			return nil, errors.Errorf("rewrite from %q to %q must not involve the root", rw.From, rw.To)
+		}
+
+		normalized[i] = Rewrite{From: from, To: to}
+	}
+	return normalized, nil
+}
+
+var errReplaceRewritesWithoutPrefix = errors.New("restoring with rewrites in replace mode requires a prefix, otherwise the whole database is replaced")
+
+// checkRewritePrefix refuses to replace the whole database when rewrites
+// are given, which would remove everything outside of the rewrite targets.
+func checkRewritePrefix(mode RestoreMode, prefix string, rewrites []Rewrite) error {
+	if len(rewrites) == 0 || (mode != "" && mode != RestoreReplace) {
+		return nil
+	}
+
+	prefix, err := paths.Normalize(prefix)
+	if err != nil {
+		return err
+	}
+
+	if prefix == "" {
+		return errReplaceRewritesWithoutPrefix
+	}
+
+	return nil
+}
+
+// rewrite applies the first rewrite matching pth.
+func rewrite(rewrites []Rewrite, pth string) (string, bool) {
+	for _, rw := range rewrites {
+		if isWithin(pth, rw.From) {
+			return rw.To + strings.TrimPrefix(pth, rw.From), true
+		}
+	}
+	return pth, false
+}
@@ -0,0 +1,111 @@
+package backup_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreWithRewrite(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		for _, m := range []string{"tenants", "tenants/acme", "tenants/acme/users"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Put("tenants/acme/name", []byte("Acme"))
+		if err != nil {
+			return err
+		}
+		return tx.Put("tenants/acme/users/1", []byte("john"))
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+	bk := rec.Body.Bytes()
+
+	get := func(pth string) string {
+		var v []byte
+		err := b.DB.Read(func(tx bolted.ReadTx) (err error) {
+			v, err = tx.Get(pth)
+			return err
+		})
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	t.Run("endpoint", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest(
+			"PUT",
+			"/backup?prefix=tenants/acme-staging&rewriteFrom=tenants/acme&rewriteTo=tenants/acme-staging",
+			bytes.NewReader(bk),
+		))
+		require.Equal(t, 200, rec.Code)
+
+		require.Equal(t, "Acme", get("tenants/acme-staging/name"))
+		require.Equal(t, "john", get("tenants/acme-staging/users/1"))
+		require.Equal(t, "Acme", get("tenants/acme/name"))
+	})
+
+	t.Run("creating missing parents", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err := backup.RestoreWithOptions(tx, bytes.NewReader(bk), backup.RestoreOptions{
+				Mode: backup.RestoreMerge,
+				Rewrites: []backup.Rewrite{
+					{From: "tenants/acme", To: "staging/tenants/acme"},
+				},
+			})
+			return err
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, "john", get("staging/tenants/acme/users/1"))
+	})
+
+	t.Run("replace without prefix", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest(
+			"PUT",
+			"/backup?rewriteFrom=tenants/acme&rewriteTo=tenants/acme-copy",
+			bytes.NewReader(bk),
+		))
+		require.Equal(t, 400, rec.Code)
+
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err := backup.RestoreWithOptions(tx, bytes.NewReader(bk), backup.RestoreOptions{
+				Rewrites: []backup.Rewrite{
+					{From: "tenants/acme", To: "tenants/acme-copy"},
+				},
+			})
+			return err
+		})
+		require.Error(t, err)
+
+		// nothing has been cleared
+		require.Equal(t, "Acme", get("tenants/acme/name"))
+		require.Equal(t, "john", get("staging/tenants/acme/users/1"))
+	})
+
+	t.Run("unpaired rewrite parameters", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/backup?rewriteFrom=tenants/acme", bytes.NewReader(bk)))
+		require.Equal(t, 400, rec.Code)
+	})
+}
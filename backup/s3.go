@@ -0,0 +1,358 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/draganm/boltimore/clock"
+	"github.com/pkg/errors"
+)
+
+const defaultS3PartSize = 8 * 1024 * 1024
+
+// S3Config configures an S3 compatible target.
+type S3Config struct {
+	// Endpoint is the base URL of the service, such as
+	// https://s3.eu-central-1.amazonaws.com. Buckets are addressed path style.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the names of the backups, such as "backups/".
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PartSize is the size of the parts of multipart uploads, 8MiB by default.
+	// S3 requires all parts but the last one to be at least 5MiB.
+	PartSize int
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Clock provides the dates of the request signatures, the wall clock by
+	// default.
+	Clock clock.Clock
+}
+
+// S3Target uploads backups to an S3 compatible object storage using
+// multipart uploads signed with AWS signature version 4.
+func S3Target(config S3Config) Target {
+	if config.PartSize <= 0 {
+		config.PartSize = defaultS3PartSize
+	}
+
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+
+	return &s3Target{config: config}
+}
+
+type s3Target struct {
+	config S3Config
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+func (t *s3Target) Upload(ctx context.Context, name string, r io.Reader) error {
+	key := t.config.Prefix + name
+
+	res, err := t.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return errors.Wrap(err, "while initiating multipart upload")
+	}
+
+	initiated := s3InitiateMultipartUploadResult{}
+	err = xml.Unmarshal(res, &initiated)
+	if err != nil {
+		return errors.Wrap(err, "while parsing initiated multipart upload")
+	}
+
+	err = t.uploadParts(ctx, key, initiated.UploadID, r)
+	if err != nil {
+		// the context might be the reason of the failure
+		_, abortErr := t.do(context.Background(), "DELETE", key, url.Values{"uploadId": {initiated.UploadID}}, nil)
+		if abortErr != nil {
+			return errors.Wrapf(err, "while uploading (aborting the upload failed: %s)", abortErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (t *s3Target) uploadParts(ctx context.Context, key, uploadID string, r io.Reader) error {
+	complete := s3CompleteMultipartUpload{}
+	buf := make([]byte, t.config.PartSize)
+
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && partNumber > 1 {
+			break
+		}
+
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "while reading backup")
+		}
+
+		etag, err := t.uploadPart(ctx, key, uploadID, partNumber, buf[:n])
+		if err != nil {
+			return errors.Wrapf(err, "while uploading part %d", partNumber)
+		}
+
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: etag})
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	d, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	// the upload is only completed when the object does not exist yet
+	req, err := t.newRequest(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, http.Header{"If-None-Match": {"*"}}, d)
+	if err != nil {
+		return err
+	}
+
+	res, err := t.send(req)
+	if err != nil {
+		return errors.Wrap(err, "while completing multipart upload")
+	}
+
+	// S3 reports some failures of completing an upload with status 200
+	s3Err := s3Error{}
+	if xml.Unmarshal(res, &s3Err) == nil && s3Err.XMLName.Local == "Error" {
+		return errors.Wrap(s3Err, "while completing multipart upload")
+	}
+
+	return nil
+}
+
+func (t *s3Target) uploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+
+	req, err := t.newRequest(ctx, "PUT", key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := t.config.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	err = checkS3Response(res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Header.Get("ETag"), nil
+}
+
+func (t *s3Target) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := t.newRequest(ctx, method, key, query, nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.send(req)
+}
+
+func (t *s3Target) send(req *http.Request) ([]byte, error) {
+	res, err := t.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	err = checkS3Response(res)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (t *s3Target) newRequest(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(t.config.Endpoint, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing endpoint")
+	}
+
+	escaped := []string{}
+	for _, part := range strings.Split(t.config.Bucket+"/"+key, "/") {
+		escaped = append(escaped, escapeURIComponent(part))
+	}
+
+	// signature version 4 needs the path escaped more strictly than net/url does
+	u.RawPath = u.EscapedPath() + "/" + strings.Join(escaped, "/")
+	u.Path = u.Path + "/" + t.config.Bucket + "/" + key
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	signV4(req, body, t.config.AccessKeyID, t.config.SecretAccessKey, t.config.Region, "s3", t.config.Clock.Now())
+
+	return req, nil
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func (e s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func checkS3Response(res *http.Response) error {
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return ErrBackupExists
+	}
+
+	d, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	s3Err := s3Error{}
+	if xml.Unmarshal(d, &s3Err) == nil && s3Err.Code != "" {
+		return errors.Wrapf(s3Err, "unexpected status %d", res.StatusCode)
+	}
+
+	return errors.Errorf("unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(d)))
+}
+
+// signV4 adds the headers of AWS signature version 4 to the request.
+// All headers set on the request and the host are signed.
+func signV4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, k := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by key with spaces encoded as %20,
+// as required by signature version 4.
+func canonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// escapeURIComponent escapes everything but unreserved characters.
+func escapeURIComponent(s string) string {
+	b := &strings.Builder{}
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
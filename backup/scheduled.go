@@ -0,0 +1,316 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/pkg/errors"
+)
+
+const (
+	backupFilePrefix     = "backup-"
+	backupFileSuffix     = ".dump"
+	backupFileTimeFormat = "20060102T150405Z"
+
+	tempFilePattern = ".backup-*.tmp"
+	// temporary files that have not been written to for this long are left
+	// over by crashed backups and removed by Prune
+	staleTempFileAge = time.Hour
+)
+
+// Retention decides which backup files are kept by Prune.
+// A backup is kept when any of Last, Daily or Weekly selects it and it is not
+// older than MaxAge. Zero values disable the respective rule, when all of
+// them are zero, all backups are kept.
+type Retention struct {
+	// Last keeps the newest backups.
+	Last int
+	// Daily keeps the newest backup of each of the last days with backups.
+	Daily int
+	// Weekly keeps the newest backup of each of the last ISO weeks with backups.
+	Weekly int
+	// MaxAge removes backups older than it.
+	MaxAge time.Duration
+}
+
+// Scheduled writes a backup of the whole database into dir on the given cron
+// schedule and prunes the backups in dir according to retention afterwards.
+func Scheduled(dir, schedule string, retention Retention, opts ...Option) boltimore.Option {
+	return boltimore.CronFunction(schedule, func(cfc *boltimore.CronFunctionContext) {
+		now := cfc.Clock.Now()
+		logger := cfc.Logger.With("dir", dir)
+
+		fileName, err := WriteBackupFile(cfc.DB, dir, now, opts...)
+		if err != nil {
+			logger.With("error", err).Error("scheduled backup failed")
+			return
+		}
+
+		logger = logger.With("file", fileName)
+
+		removed, err := Prune(dir, retention, now)
+		if err != nil {
+			logger.With("error", err).Error("while pruning backups")
+			return
+		}
+
+		logger.With("pruned", removed).Info("scheduled backup written")
+	})
+}
+
+// WriteBackupFile atomically writes a backup of the whole database into dir
+// named after the time of the backup and returns the name of the file.
+// Backups written within the same second get the suffixes -1, -2, ...
+func WriteBackupFile(db boltimore.Database, dir string, now time.Time, opts ...Option) (string, error) {
+	c := newConfig(opts)
+
+	fileName, err := writeNewFileAtomically(dir, func(seq int) string {
+		return backupFileName(now, seq)
+	}, func(w io.Writer) error {
+		return db.Read(func(tx bolted.ReadTx) error {
+			return c.writeBackup(c.compression, w, func(w io.Writer) error {
+				return Backup(tx, "", w)
+			})
+		})
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "while writing backup")
+	}
+
+	return fileName, nil
+}
+
+func backupFileName(now time.Time, seq int) string {
+	name := backupFilePrefix + now.UTC().Format(backupFileTimeFormat)
+	if seq > 0 {
+		name += "-" + strconv.Itoa(seq)
+	}
+	return name + backupFileSuffix
+}
+
+// writeNewFileAtomically writes the file like writeFileAtomically, without
+// replacing existing files: the file is linked to the first name returned by
+// name that does not exist yet.
+func writeNewFileAtomically(dir string, name func(seq int) string, write func(w io.Writer) error) (string, error) {
+	var fileName string
+
+	err := writeTempFile(dir, write, func(tempName string) error {
+		for seq := 0; ; seq++ {
+			fileName = filepath.Join(dir, name(seq))
+			err := os.Link(tempName, fileName)
+			if os.IsExist(err) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			return os.Remove(tempName)
+		}
+	})
+
+	return fileName, err
+}
+
+// writeFileAtomically writes the file through a synced temporary file in the
+// same directory, which is renamed once it is complete.
+func writeFileAtomically(fileName string, write func(w io.Writer) error) error {
+	return writeTempFile(filepath.Dir(fileName), write, func(tempName string) error {
+		return os.Rename(tempName, fileName)
+	})
+}
+
+func writeTempFile(dir string, write func(w io.Writer) error, complete func(tempName string) error) (err error) {
+	f, err := ioutil.TempFile(dir, tempFilePattern)
+	if err != nil {
+		return errors.Wrap(err, "while creating temporary file")
+	}
+
+	tempName := f.Name()
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tempName)
+		}
+	}()
+
+	err = write(f)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return complete(tempName)
+}
+
+type backupFile struct {
+	name string
+	time time.Time
+	seq  int
+}
+
+func listBackupFiles(dir string) ([]backupFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []backupFile{}
+
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, backupFilePrefix) || !strings.HasSuffix(name, backupFileSuffix) {
+			continue
+		}
+
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, backupFilePrefix), backupFileSuffix)
+
+		seq := 0
+		if i := strings.IndexByte(ts, '-'); i >= 0 {
+			seq, err = strconv.Atoi(ts[i+1:])
+			if err != nil || seq <= 0 {
+				continue
+			}
+			ts = ts[:i]
+		}
+
+		t, err := time.Parse(backupFileTimeFormat, ts)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, backupFile{name: name, time: t, seq: seq})
+	}
+
+	// newest first
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].time.Equal(files[j].time) {
+			return files[i].seq > files[j].seq
+		}
+		return files[i].time.After(files[j].time)
+	})
+
+	return files, nil
+}
+
+// Prune removes backup files from dir that are not kept by the retention
+// and temporary files left over by crashed backups, and returns the names of
+// the removed files.
+func Prune(dir string, retention Retention, now time.Time) ([]string, error) {
+	removed, err := removeStaleTempFiles(dir)
+	if err != nil {
+		return removed, err
+	}
+
+	files, err := listBackupFiles(dir)
+	if err != nil {
+		return removed, err
+	}
+
+	keep := make([]bool, len(files))
+
+	keepBuckets := func(n int, bucket func(t time.Time) string) {
+		seen := map[string]bool{}
+		for i, f := range files {
+			b := bucket(f.time)
+			if seen[b] {
+				continue
+			}
+			if len(seen) == n {
+				return
+			}
+			seen[b] = true
+			keep[i] = true
+		}
+	}
+
+	if retention.Last == 0 && retention.Daily == 0 && retention.Weekly == 0 {
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+
+	for i := 0; i < retention.Last && i < len(files); i++ {
+		keep[i] = true
+	}
+
+	keepBuckets(retention.Daily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+
+	keepBuckets(retention.Weekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", y, w)
+	})
+
+	for i, f := range files {
+		if keep[i] && (retention.MaxAge == 0 || now.Sub(f.time) <= retention.MaxAge) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(dir, f.name))
+		if err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, f.name)
+	}
+
+	return removed, nil
+}
+
+// removeStaleTempFiles removes the temporary files that haven't been written
+// to for staleTempFileAge. Their modification times are set by the file
+// system, so they are compared to the system time and not to a clock.
+func removeStaleTempFiles(dir string) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, tempFilePattern))
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return removed, err
+		}
+
+		if time.Since(fi.ModTime()) < staleTempFileAge {
+			continue
+		}
+
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+
+		removed = append(removed, filepath.Base(name))
+	}
+
+	return removed, nil
+}
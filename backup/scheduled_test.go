@@ -0,0 +1,179 @@
+package backup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func backupFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestScheduledBackup(t *testing.T) {
+	backupDir := t.TempDir()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := clocktest.NewFake(start)
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Clock(fc),
+		backup.Scheduled(backupDir, "@hourly", backup.Retention{Last: 2}),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return tx.Put("foo", []byte("bar"))
+	})
+	require.NoError(t, err)
+
+	waitForFiles := func(expected []string) {
+		for i := 0; i < 200; i++ {
+			if reflect.DeepEqual(backupFiles(t, backupDir), expected) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Equal(t, expected, backupFiles(t, backupDir))
+	}
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Hour)
+	waitForFiles([]string{"backup-20200101T010000Z.dump"})
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Hour)
+	waitForFiles([]string{"backup-20200101T010000Z.dump", "backup-20200101T020000Z.dump"})
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Hour)
+	waitForFiles([]string{"backup-20200101T020000Z.dump", "backup-20200101T030000Z.dump"})
+
+	f, err := os.Open(filepath.Join(backupDir, "backup-20200101T030000Z.dump"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	m, err := backup.Verify(f)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), m.Values)
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	createFiles := func(t *testing.T) string {
+		dir := t.TempDir()
+		// two backups a day for the last 60 days
+		for i := 0; i < 120; i++ {
+			ts := now.Add(-time.Duration(i) * 12 * time.Hour)
+			err := ioutil.WriteFile(filepath.Join(dir, "backup-"+ts.Format("20060102T150405Z")+".dump"), nil, 0600)
+			require.NoError(t, err)
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, "unrelated.txt"), nil, 0600)
+		require.NoError(t, err)
+		return dir
+	}
+
+	t.Run("keep all", func(t *testing.T) {
+		dir := createFiles(t)
+		removed, err := backup.Prune(dir, backup.Retention{}, now)
+		require.NoError(t, err)
+		require.Empty(t, removed)
+	})
+
+	t.Run("daily and weekly", func(t *testing.T) {
+		dir := createFiles(t)
+		_, err := backup.Prune(dir, backup.Retention{Last: 1, Daily: 7, Weekly: 4}, now)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{
+			"backup-20200315T120000Z.dump",
+			"backup-20200322T120000Z.dump",
+			"backup-20200325T120000Z.dump",
+			"backup-20200326T120000Z.dump",
+			"backup-20200327T120000Z.dump",
+			"backup-20200328T120000Z.dump",
+			"backup-20200329T120000Z.dump",
+			"backup-20200330T120000Z.dump",
+			"backup-20200331T120000Z.dump",
+			"unrelated.txt",
+		}, backupFiles(t, dir))
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		dir := createFiles(t)
+		_, err := backup.Prune(dir, backup.Retention{Weekly: 10, MaxAge: 14 * 24 * time.Hour}, now)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{
+			"backup-20200322T120000Z.dump",
+			"backup-20200329T120000Z.dump",
+			"backup-20200331T120000Z.dump",
+			"unrelated.txt",
+		}, backupFiles(t, dir))
+	})
+}
+
+func TestBackupFilesWithinASecond(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+
+	dir := t.TempDir()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		_, err = backup.WriteBackupFile(b.DB, dir, now.Add(time.Duration(i)*100*time.Millisecond))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{
+		"backup-20200101T000000Z-1.dump",
+		"backup-20200101T000000Z-2.dump",
+		"backup-20200101T000000Z.dump",
+	}, backupFiles(t, dir))
+
+	removed, err := backup.Prune(dir, backup.Retention{Last: 1}, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"backup-20200101T000000Z-1.dump", "backup-20200101T000000Z.dump"}, removed)
+}
+
+func TestPruneStaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{".backup-1.tmp", ".backup-2.tmp"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+		require.NoError(t, err)
+	}
+
+	// a crashed backup
+	old := time.Now().Add(-2 * time.Hour)
+	err := os.Chtimes(filepath.Join(dir, ".backup-1.tmp"), old, old)
+	require.NoError(t, err)
+
+	removed, err := backup.Prune(dir, backup.Retention{Last: 1}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{".backup-1.tmp"}, removed)
+
+	// the backup in progress is kept
+	require.Equal(t, []string{".backup-2.tmp"}, backupFiles(t, dir))
+}
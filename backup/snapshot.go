@@ -0,0 +1,186 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotParameter     = "snapshot"
+	offsetParameter       = "offset"
+	snapshotIDHeader      = "Snapshot-Id"
+	backupEntriesHeader   = "Backup-Entries"
+	backupBytesHeader     = "Backup-Bytes"
+	backupSHA256Header    = "Backup-Sha256"
+	snapshotFileSuffix    = ".snapshot"
+	snapshotHeadersSuffix = ".headers"
+)
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// WithSnapshotRetention makes the backup endpoint write each backup into a
+// snapshot file in dir before sending it, which is kept for ttl.
+// Responses have a Content-Length and the ID of the snapshot in the
+// Snapshot-Id header. Interrupted downloads can be resumed while the
+// snapshot is retained by requesting the backup with the snapshot query
+// parameter and a Range header or the offset query parameter.
+func WithSnapshotRetention(dir string, ttl time.Duration) Option {
+	return func(c *config) {
+		c.snapshots = &snapshotStore{dir: dir, ttl: ttl}
+	}
+}
+
+// manifestHeaders sets the headers describing the dump.
+func manifestHeaders(h http.Header, m *Manifest) {
+	h.Set(backupEntriesHeader, strconv.FormatInt(m.Entries, 10))
+	h.Set(backupBytesHeader, strconv.FormatInt(m.Bytes, 10))
+	h.Set(backupSHA256Header, m.SHA256)
+}
+
+// snapshotStore keeps the snapshot files and the response headers they
+// have been sent with.
+type snapshotStore struct {
+	dir string
+	ttl time.Duration
+}
+
+// create writes a new snapshot and returns its ID.
+// The modification time of the snapshot file is set to now, which is when
+// it expires from.
+func (s *snapshotStore) create(now time.Time, write func(w io.Writer) error) (string, error) {
+	err := s.prune(now)
+	if err != nil {
+		return "", errors.Wrap(err, "while pruning snapshots")
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(b)
+
+	fileName := filepath.Join(s.dir, id+snapshotFileSuffix)
+
+	err = writeFileAtomically(fileName, write)
+	if err != nil {
+		return "", errors.Wrap(err, "while writing snapshot")
+	}
+
+	err = os.Chtimes(fileName, now, now)
+	if err != nil {
+		return "", errors.Wrap(err, "while setting snapshot time")
+	}
+
+	return id, nil
+}
+
+// saveHeaders stores the headers the snapshot is served with.
+func (s *snapshotStore) saveHeaders(id string, h http.Header) error {
+	return writeFileAtomically(filepath.Join(s.dir, id+snapshotHeadersSuffix), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(h)
+	})
+}
+
+// serve sends the snapshot, honouring Range requests.
+func (s *snapshotStore) serve(w http.ResponseWriter, r *http.Request, id string, now time.Time) error {
+	if !isSnapshotID(id) {
+		return errSnapshotNotFound
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, id+snapshotFileSuffix))
+	if os.IsNotExist(err) {
+		return errSnapshotNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if s.expired(fi, now) {
+		return errSnapshotNotFound
+	}
+
+	d, err := ioutil.ReadFile(filepath.Join(s.dir, id+snapshotHeadersSuffix))
+	if err != nil {
+		return errors.Wrap(err, "while reading snapshot headers")
+	}
+
+	h := http.Header{}
+	err = json.Unmarshal(d, &h)
+	if err != nil {
+		return errors.Wrap(err, "while parsing snapshot headers")
+	}
+
+	for k, v := range h {
+		w.Header()[k] = v
+	}
+
+	w.Header().Set(snapshotIDHeader, id)
+	w.Header().Set("ETag", strconv.Quote(id))
+
+	offset := r.URL.Query().Get(offsetParameter)
+	if offset != "" && r.Header.Get("Range") == "" {
+		_, err = strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "while parsing %s", offsetParameter)
+		}
+		r.Header.Set("Range", "bytes="+offset+"-")
+	}
+
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return nil
+}
+
+func (s *snapshotStore) expired(fi os.FileInfo, now time.Time) bool {
+	return now.Sub(fi.ModTime()) > s.ttl
+}
+
+// prune removes the expired snapshots.
+func (s *snapshotStore) prune(now time.Time) error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, snapshotFileSuffix) || !s.expired(fi, now) {
+			continue
+		}
+
+		id := strings.TrimSuffix(name, snapshotFileSuffix)
+
+		for _, fn := range []string{name, id + snapshotHeadersSuffix} {
+			err = os.Remove(filepath.Join(s.dir, fn))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func isSnapshotID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
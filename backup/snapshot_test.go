@@ -0,0 +1,127 @@
+package backup_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func putValues(t *testing.T, b *boltimore.Boltimore, n int) {
+	err := b.DB.Write(func(tx bolted.WriteTx) error {
+		for i := 0; i < n; i++ {
+			err := tx.Put(fmt.Sprintf("key%03d", i), []byte("value"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBackupTrailers(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir(), boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint))
+	require.NoError(t, err)
+	defer b.Close()
+
+	putValues(t, b, 10)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+
+	res := rec.Result()
+	require.Equal(t, "10", res.Trailer.Get("Backup-Entries"))
+	require.NotEmpty(t, res.Trailer.Get("Backup-Bytes"))
+	require.Len(t, res.Trailer.Get("Backup-Sha256"), 64)
+}
+
+func TestBackupSnapshotRetention(t *testing.T) {
+	snapshotDir := t.TempDir()
+	clk := clocktest.NewFake(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Clock(clk),
+		boltimore.Endpoint("GET", "/backup", backup.NewBackupEndpoint(backup.WithSnapshotRetention(snapshotDir, time.Hour))),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	putValues(t, b, 100)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+
+	full := rec.Body.Bytes()
+	id := rec.Header().Get("Snapshot-Id")
+	require.NotEmpty(t, id)
+	require.Equal(t, strconv.Itoa(len(full)), rec.Header().Get("Content-Length"))
+	require.Equal(t, "100", rec.Header().Get("Backup-Entries"))
+
+	// changes after the snapshot are not part of resumed downloads
+	putValues(t, b, 200)
+
+	t.Run("resuming with a range", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/backup?snapshot="+id, nil)
+		req.Header.Set("Range", "bytes=100-")
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		require.Equal(t, 206, rec.Code)
+		require.Equal(t, full[100:], rec.Body.Bytes())
+		require.Equal(t, "100", rec.Header().Get("Backup-Entries"))
+	})
+
+	t.Run("resuming with an offset", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?snapshot="+id+"&offset=200", nil))
+		require.Equal(t, 206, rec.Code)
+		require.Equal(t, full[200:], rec.Body.Bytes())
+	})
+
+	t.Run("invalid offset", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?snapshot="+id+"&offset=foo", nil))
+		require.Equal(t, 400, rec.Code)
+	})
+
+	t.Run("unknown snapshot", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?snapshot=../foo", nil))
+		require.Equal(t, 404, rec.Code)
+	})
+
+	t.Run("expired snapshot", func(t *testing.T) {
+		clk.Advance(59 * time.Minute)
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?snapshot="+id, nil))
+		require.Equal(t, 200, rec.Code)
+
+		clk.Advance(2 * time.Minute)
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?snapshot="+id, nil))
+		require.Equal(t, 404, rec.Code)
+
+		// expired snapshots are removed when the next one is created
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+		require.Equal(t, 200, rec.Code)
+
+		_, err := os.Stat(filepath.Join(snapshotDir, id+".snapshot"))
+		require.True(t, os.IsNotExist(err))
+	})
+}
@@ -0,0 +1,275 @@
+package backup
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dump"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+const defaultBatchSize = 10000
+
+// StagedRestoreOptions configures RestoreStaged.
+type StagedRestoreOptions struct {
+	// AllowUnverified permits restoring dumps without a manifest.
+	AllowUnverified bool
+	// BatchSize is the number of entries written per transaction, 10000 by default.
+	BatchSize int
+	// Progress is called with the number of restored entries after each batch.
+	Progress func(entries int64)
+}
+
+// RestoreStaged replaces the whole database with a full dump. The dump is
+// written into a staging database in transactions of at most BatchSize
+// entries, which is swapped in when the whole dump has been restored and
+// verified. The database is only blocked while it is swapped. When it has
+// been changed while the dump was restored, it is not replaced and
+// boltimore.ErrChangedWhileStaging is returned. Changes of internal maps,
+// like the job queues, don't count, see boltimore.ReplaceStaged.
+// When the change log is enabled, backups taken before the restore can't
+// be used as the base of incremental backups anymore.
+// RestoreStaged must not be called from an endpoint added by boltimore.Endpoint.
+func RestoreStaged(b *boltimore.Boltimore, r io.Reader, opts StagedRestoreOptions) (*Manifest, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	dr, err := decompressingReader(r, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening compressed dump")
+	}
+	defer dr.Close()
+
+	var m *Manifest
+
+	err = b.ReplaceStaged(func(sc *boltimore.StagingContext) error {
+		tr := newDumpReader(dr)
+		entries := int64(0)
+
+		for done := false; !done; {
+			err := sc.DB.Write(func(tx bolted.WriteTx) error {
+				for n := 0; n < opts.BatchSize; n++ {
+					nx, err := tr.Next()
+					if err == io.EOF {
+						done = true
+						return nil
+					}
+
+					if err != nil {
+						return invalidDump{errors.Wrap(err, "while reading next dump entry")}
+					}
+
+					key, err := paths.Normalize(nx.Key)
+					if err != nil {
+						return err
+					}
+
+					if key == "" || isExcluded(key) {
+						continue
+					}
+
+					switch nx.Type {
+					case dump.CreateMap:
+						err = tx.CreateMap(key)
+					case dump.Put:
+						err = tx.Put(key, nx.Value)
+					case Deletion:
+						return errIncrementalReplace
+					default:
+						return errors.Errorf("unsupported type %d", nx.Type)
+					}
+
+					if err != nil {
+						return errors.Wrapf(err, "while restoring %s", key)
+					}
+
+					entries++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			sc.Logger.With("entries", entries).Info("staged restore progress")
+
+			if opts.Progress != nil {
+				opts.Progress(entries)
+			}
+		}
+
+		m = tr.Manifest()
+		if m == nil && !opts.AllowUnverified {
+			return invalidDump{ErrUnverified}
+		}
+
+		if m != nil && m.Since != 0 {
+			return errIncrementalReplace
+		}
+
+		return continueChangeLog(b.DB, sc.DB)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// continueChangeLog starts the change log of the staging database after the
+// sequence of the live one, with all earlier backups pruned.
+func continueChangeLog(live boltimore.Database, staging *bolted.Bolted) error {
+	var seq uint64
+	var enabled bool
+
+	err := live.Read(func(tx bolted.ReadTx) (err error) {
+		enabled, err = tx.Exists(changeLogMapName)
+		if err != nil || !enabled {
+			return err
+		}
+		seq, err = ChangeSequence(tx)
+		return err
+	})
+	if err != nil || !enabled {
+		return err
+	}
+
+	return staging.Write(func(tx bolted.WriteTx) error {
+		err := ensureChangeLogMaps(tx)
+		if err != nil {
+			return err
+		}
+
+		err = writeCounter(tx, sequenceKey, seq+1)
+		if err != nil {
+			return err
+		}
+
+		return writeCounter(tx, prunedKey, seq+1)
+	})
+}
+
+// StagedRestoreStatus is the state of the last staged restore.
+type StagedRestoreStatus struct {
+	// State is one of idle, running, succeeded and failed.
+	State    string     `json:"state"`
+	Entries  int64      `json:"entries"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// StagedRestoreEndpoints adds a PUT endpoint at path restoring the uploaded
+// dump with RestoreStaged and a GET endpoint at path/status reporting the
+// progress of the running or the last restore. Only one staged restore runs
+// at a time, others are rejected with 409, as are restores during which the
+// database has been changed.
+func StagedRestoreEndpoints(path string, opts ...Option) boltimore.Option {
+	c := newConfig(opts)
+
+	return func(b *boltimore.Boltimore) error {
+		mu := new(sync.Mutex)
+		status := StagedRestoreStatus{State: "idle"}
+
+		update := func(fn func(s *StagedRestoreStatus)) {
+			mu.Lock()
+			fn(&status)
+			mu.Unlock()
+		}
+
+		// the endpoints are not added with boltimore.Endpoint, which would
+		// block the database from being replaced
+		b.Router.Methods("GET").Path(path + "/status").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			s := status
+			mu.Unlock()
+			respondWithJSON(w, s)
+		})
+
+		b.Router.Methods("PUT").Path(path).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			running := false
+			update(func(s *StagedRestoreStatus) {
+				if s.State == "running" {
+					running = true
+					return
+				}
+				now := c.clock.Now()
+				*s = StagedRestoreStatus{State: "running", Started: &now}
+			})
+
+			if running {
+				http.Error(w, "a staged restore is already running", 409)
+				return
+			}
+
+			m, err := c.restoreStaged(b, r, func(entries int64) {
+				update(func(s *StagedRestoreStatus) {
+					s.Entries = entries
+				})
+			})
+
+			update(func(s *StagedRestoreStatus) {
+				now := c.clock.Now()
+				s.Finished = &now
+				s.State = "succeeded"
+				if err != nil {
+					s.State = "failed"
+					s.Error = err.Error()
+				}
+			})
+
+			if isInvalidDump(err) {
+				http.Error(w, err.Error(), 422)
+				return
+			}
+
+			if errors.Cause(err) == errUnsupportedDump {
+				http.Error(w, err.Error(), 415)
+				return
+			}
+
+			if errors.Cause(err) == boltimore.ErrChangedWhileStaging {
+				http.Error(w, err.Error(), 409)
+				return
+			}
+
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			respondWithJSON(w, m)
+		})
+
+		return nil
+	}
+}
+
+func (c *config) restoreStaged(b *boltimore.Boltimore, r *http.Request, progress func(entries int64)) (*Manifest, error) {
+	body, err := c.openDump(r.Body, r.Header.Get("Content-Encoding"))
+	if isInvalidDump(err) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(errUnsupportedDump, err.Error())
+	}
+	defer body.Close()
+
+	return RestoreStaged(b, body, StagedRestoreOptions{
+		AllowUnverified: r.URL.Query().Get(allowUnverifiedParameter) == "true",
+		Progress:        progress,
+	})
+}
+
+func respondWithJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
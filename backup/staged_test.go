@@ -0,0 +1,188 @@
+package backup_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedRestore(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		backup.ChangeLog(),
+		backup.StagedRestoreEndpoints("/staged", backup.WithClock(clocktest.NewFake(now))),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("data")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			err = tx.Put(fmt.Sprintf("data/%03d", i), []byte{byte(i)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+	dump := rec.Body.Bytes()
+	backupID := rec.Header().Get("Backup-Id")
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.Delete("data")
+		if err != nil {
+			return err
+		}
+		return tx.Put("other", []byte("x"))
+	})
+	require.NoError(t, err)
+
+	status := func() backup.StagedRestoreStatus {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/staged/status", nil))
+		require.Equal(t, 200, rec.Code)
+		s := backup.StagedRestoreStatus{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+		return s
+	}
+
+	require.Equal(t, "idle", status().State)
+
+	t.Run("restoring in batches", func(t *testing.T) {
+		progress := []int64{}
+		m, err := backup.RestoreStaged(b, bytes.NewReader(dump), backup.StagedRestoreOptions{
+			BatchSize: 30,
+			Progress: func(entries int64) {
+				progress = append(progress, entries)
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(101), m.Entries)
+		require.Equal(t, []int64{30, 60, 90, 101}, progress)
+
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			ex, err := tx.Exists("other")
+			require.NoError(t, err)
+			require.False(t, ex)
+
+			v, err := tx.Get("data/042")
+			require.NoError(t, err)
+			require.Equal(t, []byte{42}, v)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("backups before the restore are not a base for incremental backups", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup?since="+backupID, nil))
+		require.Equal(t, 404, rec.Code)
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+		require.Equal(t, 200, rec.Code)
+		require.NotEqual(t, backupID, rec.Header().Get("Backup-Id"))
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/staged", bytes.NewReader(dump)))
+		require.Equal(t, 200, rec.Code)
+
+		s := status()
+		require.Equal(t, "succeeded", s.State)
+		require.Equal(t, int64(101), s.Entries)
+		require.True(t, now.Equal(*s.Started))
+		require.True(t, now.Equal(*s.Finished))
+	})
+
+	t.Run("invalid dump", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("PUT", "/staged", bytes.NewReader(dump[:len(dump)-10])))
+		require.Equal(t, 422, rec.Code)
+
+		s := status()
+		require.Equal(t, "failed", s.State)
+		require.NotEmpty(t, s.Error)
+
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			ex, err := tx.Exists("data/042")
+			require.NoError(t, err)
+			require.True(t, ex)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+	t.Run("unsupported encoding", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/staged", bytes.NewReader(dump))
+		req.Header.Set("Content-Encoding", "br")
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		require.Equal(t, 415, rec.Code)
+		require.Equal(t, "failed", status().State)
+	})
+
+	t.Run("changes while restoring", func(t *testing.T) {
+		_, err := backup.RestoreStaged(b, bytes.NewReader(dump), backup.StagedRestoreOptions{
+			BatchSize: 30,
+			Progress: func(entries int64) {
+				// transactions without changes don't count
+				err := b.DB.Write(func(tx bolted.WriteTx) error {
+					return nil
+				})
+				require.NoError(t, err)
+
+				// neither do changes of internal maps
+				err = b.DB.Write(func(tx bolted.WriteTx) error {
+					_, err := boltimore.Enqueue(tx, "mail", []byte("hello"), now)
+					return err
+				})
+				require.NoError(t, err)
+			},
+		})
+		require.NoError(t, err)
+
+		_, err = backup.RestoreStaged(b, bytes.NewReader(dump), backup.StagedRestoreOptions{
+			BatchSize: 30,
+			Progress: func(entries int64) {
+				if entries != 30 {
+					return
+				}
+				err := b.DB.Write(func(tx bolted.WriteTx) error {
+					return tx.Put("concurrent", []byte("x"))
+				})
+				require.NoError(t, err)
+			},
+		})
+		require.Equal(t, boltimore.ErrChangedWhileStaging, errors.Cause(err))
+
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			v, err := tx.Get("concurrent")
+			require.NoError(t, err)
+			require.Equal(t, []byte("x"), v)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/pkg/errors"
+)
+
+// Target stores backup files written by Push.
+// Upload must not replace an existing backup, it returns ErrBackupExists
+// instead.
+type Target interface {
+	Upload(ctx context.Context, name string, r io.Reader) error
+}
+
+// ErrBackupExists is returned by targets when a backup with the name already
+// exists.
+var ErrBackupExists = errors.New("backup already exists")
+
+// DirectoryTarget stores backup files in a local directory.
+func DirectoryTarget(dir string) Target {
+	return directoryTarget{dir: dir}
+}
+
+type directoryTarget struct {
+	dir string
+}
+
+func (t directoryTarget) Upload(ctx context.Context, name string, r io.Reader) error {
+	write := func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	return writeTempFile(t.dir, write, func(tempName string) error {
+		err := os.Link(tempName, filepath.Join(t.dir, name))
+		if os.IsExist(err) {
+			return ErrBackupExists
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(tempName)
+	})
+}
+
+// Push writes a backup of the whole database and uploads it to the target
+// named after the time of the backup, like the files written by
+// WriteBackupFile. Backups taken within the same second get a -N suffix.
+// It returns the name of the uploaded backup.
+// The backup is written to a temporary file first, so the read transaction
+// is not held open during the upload.
+//
+// Push can be called from a CronFunction:
+//
+//	boltimore.CronFunction("@daily", func(cfc *boltimore.CronFunctionContext) {
+//		_, err := backup.Push(context.Background(), cfc.DB, target, cfc.Clock.Now())
+//		...
+//	})
+func Push(ctx context.Context, db boltimore.Database, target Target, now time.Time, opts ...Option) (string, error) {
+	c := newConfig(opts)
+
+	f, err := ioutil.TempFile("", "backup-*.tmp")
+	if err != nil {
+		return "", errors.Wrap(err, "while creating temporary file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = db.Read(func(tx bolted.ReadTx) error {
+		return c.writeBackup(c.compression, f, func(w io.Writer) error {
+			return Backup(tx, "", w)
+		})
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "while writing backup")
+	}
+
+	for seq := 0; ; seq++ {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+
+		name := backupFileName(now, seq)
+
+		err = target.Upload(ctx, name, f)
+		if errors.Cause(err) == ErrBackupExists {
+			continue
+		}
+
+		if err != nil {
+			return "", errors.Wrapf(uploadError{err}, "while uploading backup %s", name)
+		}
+
+		return name, nil
+	}
+}
+
+// PushEndpoint pushes a backup to the target when called and responds with
+// the name of the uploaded backup.
+func PushEndpoint(target Target, opts ...Option) func(rc *boltimore.RequestContext) error {
+	return func(rc *boltimore.RequestContext) error {
+		name, err := Push(rc.Request.Context(), rc.DB, target, rc.Clock.Now(), opts...)
+		if _, isUploadError := errors.Cause(err).(uploadError); isUploadError {
+			rc.Logger.With("error", err).Error("while pushing backup")
+			return rc.RespondWithError(err.Error(), 502)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return rc.RespondWithJSON(map[string]string{
+			"name": name,
+		})
+	}
+}
+
+// uploadError marks errors returned by the target.
+type uploadError struct {
+	error
+}
@@ -0,0 +1,237 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 implements the multipart upload API of S3 for a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	uploads map[string]map[int][]byte
+	objects map[string][]byte
+	failPut bool
+	aborted int
+	dates   map[string]bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		uploads: map[string]map[int][]byte{},
+		objects: map[string][]byte{},
+		dates:   map[string]bool{},
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code><Message>not signed</Message></Error>", 403)
+		return
+	}
+
+	s.dates[r.Header.Get("X-Amz-Date")] = true
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+
+	switch {
+	case r.Method == "POST" && q["uploads"] != nil:
+		id := strconv.Itoa(len(s.uploads) + 1)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && uploadID != "":
+		if s.failPut {
+			http.Error(w, "<Error><Code>InternalError</Code><Message>failed</Message></Error>", 500)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		d, _ := ioutil.ReadAll(r.Body)
+		s.uploads[uploadID][n] = d
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", n))
+	case r.Method == "POST" && uploadID != "":
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		err := xml.NewDecoder(r.Body).Decode(&complete)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		if _, exists := s.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			http.Error(w, "<Error><Code>PreconditionFailed</Code><Message>exists</Message></Error>", 412)
+			return
+		}
+
+		object := []byte{}
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf("\"etag-%d\"", i+1) {
+				http.Error(w, "invalid part", 400)
+				return
+			}
+			object = append(object, s.uploads[uploadID][p.PartNumber]...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		s.aborted++
+		delete(s.uploads, uploadID)
+	default:
+		http.Error(w, "unsupported", 400)
+	}
+}
+
+func (s *fakeS3) objectNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for k := range s.objects {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPushToS3(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	clk := clocktest.NewFake(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	target := backup.S3Target(backup.S3Config{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		Prefix:          "backups/",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PartSize:        1024,
+		Clock:           clk,
+	})
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Clock(clk),
+		boltimore.Endpoint("POST", "/push", backup.PushEndpoint(target)),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return tx.Put("foo", bytes.Repeat([]byte{1, 2, 3}, 1000))
+	})
+	require.NoError(t, err)
+
+	t.Run("library call", func(t *testing.T) {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		name, err := backup.Push(context.Background(), b.DB, target, now)
+		require.NoError(t, err)
+		require.Equal(t, "backup-20200101T000000Z.dump", name)
+
+		fake.mu.Lock()
+		object := fake.objects["backups/"+name]
+		fake.mu.Unlock()
+
+		require.True(t, len(object) > 1024, "backup should be uploaded in several parts")
+		_, err = backup.Verify(bytes.NewReader(object))
+		require.NoError(t, err)
+	})
+
+	t.Run("push within the same second", func(t *testing.T) {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 500, time.UTC)
+		name, err := backup.Push(context.Background(), b.DB, target, now)
+		require.NoError(t, err)
+		require.Equal(t, "backup-20200101T000000Z-1.dump", name)
+		require.Contains(t, fake.objectNames(), "backups/backup-20200101T000000Z.dump")
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		require.Equal(t, 1, fake.aborted)
+		require.Empty(t, fake.uploads)
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/push", nil))
+		require.Equal(t, 200, rec.Code)
+
+		res := map[string]string{}
+		err := json.Unmarshal(rec.Body.Bytes(), &res)
+		require.NoError(t, err)
+		require.Equal(t, "backup-20210601T120000Z.dump", res["name"])
+		require.Contains(t, fake.objectNames(), "backups/"+res["name"])
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		require.Equal(t, map[string]bool{"20210601T120000Z": true}, fake.dates)
+	})
+
+	t.Run("failed upload", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.failPut = true
+		aborted := fake.aborted
+		fake.mu.Unlock()
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/push", nil))
+		require.Equal(t, 502, rec.Code)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		require.Equal(t, aborted+1, fake.aborted)
+		require.Empty(t, fake.uploads)
+	})
+}
+
+func TestPushToDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	name, err := backup.Push(context.Background(), b.DB, backup.DirectoryTarget(dir), now, backup.WithCompression(backup.CompressionGzip))
+	require.NoError(t, err)
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+
+	_, err = backup.Verify(bytes.NewReader(d))
+	require.NoError(t, err)
+
+	name, err = backup.Push(context.Background(), b.DB, backup.DirectoryTarget(dir), now)
+	require.NoError(t, err)
+	require.Equal(t, "backup-20200101T000000Z-1.dump", name)
+
+	same, err := ioutil.ReadFile(filepath.Join(dir, "backup-20200101T000000Z.dump"))
+	require.NoError(t, err)
+	require.Equal(t, d, same)
+}
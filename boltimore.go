@@ -4,21 +4,43 @@ import (
 	"context"
 	"path/filepath"
 	"reflect"
+	"sync"
 
 	"github.com/draganm/bolted"
 	"github.com/draganm/bolted/watcher"
+	"github.com/draganm/boltimore/clock"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
-	"github.com/robfig/cron/v3"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
 type Boltimore struct {
 	*mux.Router
-	DB      *bolted.Bolted
-	cr      *cron.Cron
-	Watcher *watcher.Watcher
-	logger  *zap.SugaredLogger
+	DB       *DB
+	cr       *scheduler
+	Watcher  *watcher.Watcher
+	logger   *zap.SugaredLogger
+	clock    clock.Clock
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       *sync.WaitGroup
+	starters []func()
+
+	// dbPath and listeners are only set when the database was opened by Open
+	dbPath    string
+	listeners *changeListeners
+	// swapMu is held for reading by endpoints and for writing while the
+	// database file is replaced
+	swapMu *sync.RWMutex
+
+	migrations      []migration
+	migrationDryRun func(statuses []MigrationStatus)
+	initFunctions   []func(ifc *InitFunctionContext) error
+
+	onStart []func(lc *LifecycleContext) error
+	onStop  []stopHook
+	workers []*supervisedWorker
 }
 
 type Option func(b *Boltimore) error
@@ -31,30 +53,32 @@ func Endpoint(method, path string, fn func(rc *RequestContext) error) Option {
 }
 
 type InitFunctionContext struct {
-	DB     *bolted.Bolted
+	DB     *DB
 	Logger *zap.SugaredLogger
 }
 
+// InitFunction registers a function that is run by Open after the
+// migrations have been applied and before the OnStart hooks.
 func InitFunction(fn func(ifc *InitFunctionContext) error) Option {
 	return Option(func(b *Boltimore) error {
-		return fn(&InitFunctionContext{
-			DB:     b.DB,
-			Logger: b.logger,
-		})
+		b.initFunctions = append(b.initFunctions, fn)
+		return nil
 	})
 }
 
 type CronFunctionContext struct {
-	DB     *bolted.Bolted
+	DB     *DB
 	Logger *zap.SugaredLogger
+	Clock  clock.Clock
 }
 
 func CronFunction(schedule string, fn func(cfc *CronFunctionContext)) Option {
 	return Option(func(b *Boltimore) error {
-		_, err := b.cr.AddFunc(schedule, func() {
+		err := b.cr.addFunc(schedule, func() {
 			fn(&CronFunctionContext{
 				DB:     b.DB,
 				Logger: b.logger.With("cronFunction", schedule),
+				Clock:  b.clock,
 			})
 		})
 
@@ -67,26 +91,32 @@ func CronFunction(schedule string, fn func(cfc *CronFunctionContext)) Option {
 }
 
 type ChangeWatcherContext struct {
-	DB     *bolted.Bolted
+	DB     *DB
 	Logger *zap.SugaredLogger
 }
 
 func ChangeWatcher(path string, fn func(cwc *ChangeWatcherContext)) Option {
 	return Option(func(b *Boltimore) error {
-		ch := make(chan struct{})
-		go b.Watcher.WatchForChanges(context.Background(), path, func(c bolted.ReadTx) error {
-			ch <- struct{}{}
-			return nil
-		})
+		b.goBackground(func(ctx context.Context) {
+			ch := make(chan struct{})
+			go func() {
+				defer close(ch)
+				b.Watcher.WatchForChanges(ctx, path, func(c bolted.ReadTx) error {
+					select {
+					case ch <- struct{}{}:
+					case <-ctx.Done():
+					}
+					return nil
+				})
+			}()
 
-		go func() {
 			for range ch {
 				fn(&ChangeWatcherContext{
 					DB:     b.DB,
 					Logger: b.logger.With("changeWatcher", path),
 				})
 			}
-		}()
+		})
 		return nil
 	})
 }
@@ -98,38 +128,98 @@ func ZapLogger(l *zap.SugaredLogger) Option {
 	})
 }
 
+// Clock replaces the wall clock used by the cron scheduler and other time
+// based features. It is mostly useful for tests, see clock/clocktest.
+func Clock(c clock.Clock) Option {
+	return Option(func(b *Boltimore) error {
+		b.clock = c
+		return nil
+	})
+}
+
 func Open(dir string, options ...Option) (*Boltimore, error) {
 	w := watcher.New()
-	db, err := bolted.Open(filepath.Join(dir, "db"), 0700, bolted.WithChangeListeners(w))
+	listeners := newChangeListeners()
+	dbPath := filepath.Join(dir, "db")
+	db, err := openDB(dbPath, w, listeners)
 	if err != nil {
 		return nil, errors.Wrap(err, "while opening db")
 	}
+
+	options = append([]Option{func(b *Boltimore) error {
+		b.dbPath = dbPath
+		b.listeners = listeners
+		b.DB.deletes = bolted.CompositeChangeListener{w, listeners}
+		return nil
+	}}, options...)
+
 	return NewWithExistingDBAndWatcher(db, w, options...)
 }
 
+func openDB(dbPath string, w *watcher.Watcher, listeners *changeListeners) (*bolted.Bolted, error) {
+	return bolted.Open(dbPath, 0700, bolted.WithChangeListeners(w, listeners))
+}
+
 func NewWithExistingDBAndWatcher(db *bolted.Bolted, w *watcher.Watcher, options ...Option) (*Boltimore, error) {
 	logger, err := zap.NewProduction()
 	if err != nil {
 		return nil, errors.Wrap(err, "while creating initial ZAP logger")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	b := &Boltimore{
 		Router:  mux.NewRouter(),
-		DB:      db,
-		cr:      cron.New(),
+		DB:      newDB(db),
+		cr:      newScheduler(),
 		Watcher: w,
 		logger:  logger.Sugar(),
+		clock:   clock.New(),
+		ctx:     ctx,
+		cancel:  cancel,
+		wg:      new(sync.WaitGroup),
+		swapMu:  new(sync.RWMutex),
 	}
 
 	for _, o := range options {
 		err = o(b)
 		if err != nil {
+			cancel()
+			db.Close()
+			return nil, err
+		}
+	}
+
+	err = b.runMigrations()
+	if err != nil {
+		cancel()
+		db.Close()
+		return nil, err
+	}
+
+	for _, fn := range b.initFunctions {
+		err = fn(&InitFunctionContext{
+			DB:     b.DB,
+			Logger: b.logger,
+		})
+		if err != nil {
+			cancel()
+			db.Close()
+			return nil, err
+		}
+	}
+
+	for i, fn := range b.onStart {
+		err = fn(b.lifecycleContext())
+		if err != nil {
+			err = multierr.Append(errors.Wrap(err, "while running start hook"), b.runStopHooks(i))
+			cancel()
 			db.Close()
 			return nil, err
 		}
 	}
 
-	b.cr.Start()
+	b.startBackground()
 
 	return b, nil
 
@@ -140,8 +230,41 @@ var boltedWriteTxType = reflect.TypeOf((*bolted.WriteTx)(nil)).Elem()
 var boltedReadTxType = reflect.TypeOf((*bolted.ReadTx)(nil)).Elem()
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
 
+// goBackground runs fn in a goroutine once the instance is started.
+// The context passed to fn is cancelled by Close, which then waits for fn
+// to return before closing the database.
+func (b *Boltimore) goBackground(fn func(ctx context.Context)) {
+	b.starters = append(b.starters, func() {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			fn(b.ctx)
+		}()
+	})
+}
+
+// startBackground starts the cron scheduler and the background goroutines.
+func (b *Boltimore) startBackground() {
+	b.cr.start(b.clock)
+
+	for _, s := range b.starters {
+		s()
+	}
+}
+
+// stopBackground stops the cron scheduler and the background goroutines and
+// waits for them to return.
+func (b *Boltimore) stopBackground() {
+	b.cancel()
+	b.cr.shutdown()
+	b.wg.Wait()
+}
+
 func (b *Boltimore) Close() error {
 	b.logger.Sync()
-	b.cr.Stop()
-	return b.DB.Close()
+	b.stopBackground()
+
+	err := b.runStopHooks(len(b.onStart))
+
+	return multierr.Append(err, b.DB.close())
 }
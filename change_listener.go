@@ -0,0 +1,119 @@
+package boltimore
+
+import (
+	"sync"
+
+	"github.com/draganm/bolted"
+	"github.com/pkg/errors"
+)
+
+// ChangeListener adds a listener to the change notifications of the database.
+// The listener is notified of changes made after the option is applied.
+func ChangeListener(cl bolted.ChangeListener) Option {
+	return Option(func(b *Boltimore) error {
+		if b.listeners == nil {
+			return errors.New("change listeners are only supported for databases opened by Open")
+		}
+
+		err := cl.Opened(b.DB.db)
+		if err != nil {
+			return err
+		}
+
+		b.listeners.add(cl)
+		return nil
+	})
+}
+
+// changeListeners is registered when the database is opened and passes
+// notifications on to the listeners added later by options.
+// It also counts the committed transactions that changed the database
+// outside of internal maps.
+type changeListeners struct {
+	mu        *sync.Mutex
+	listeners bolted.CompositeChangeListener
+	changed   bool
+	commits   uint64
+}
+
+func newChangeListeners() *changeListeners {
+	return &changeListeners{
+		mu: new(sync.Mutex),
+	}
+}
+
+func (c *changeListeners) add(cl bolted.ChangeListener) {
+	c.mu.Lock()
+	c.listeners = append(c.listeners, cl)
+	c.mu.Unlock()
+}
+
+func (c *changeListeners) get() bolted.CompositeChangeListener {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listeners
+}
+
+// committedChanges returns the number of committed transactions that
+// changed the database outside of internal maps.
+func (c *changeListeners) committedChanges() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commits
+}
+
+func (c *changeListeners) setChanged(changed bool) {
+	c.mu.Lock()
+	c.changed = changed
+	c.mu.Unlock()
+}
+
+func (c *changeListeners) changedPath(pth string) {
+	internal, _ := InternalMap(pth)
+	if !internal {
+		c.setChanged(true)
+	}
+}
+
+func (c *changeListeners) Opened(b *bolted.Bolted) error {
+	return c.get().Opened(b)
+}
+
+func (c *changeListeners) Start(w bolted.WriteTx) error {
+	c.setChanged(false)
+	return c.get().Start(w)
+}
+
+func (c *changeListeners) Delete(w bolted.WriteTx, path string) error {
+	c.changedPath(path)
+	return c.get().Delete(w, path)
+}
+
+func (c *changeListeners) CreateMap(w bolted.WriteTx, path string) error {
+	c.changedPath(path)
+	return c.get().CreateMap(w, path)
+}
+
+func (c *changeListeners) Put(w bolted.WriteTx, path string, newValue []byte) error {
+	c.changedPath(path)
+	return c.get().Put(w, path, newValue)
+}
+
+func (c *changeListeners) BeforeCommit(w bolted.WriteTx) error {
+	return c.get().BeforeCommit(w)
+}
+
+func (c *changeListeners) AfterTransaction(err error) error {
+	c.mu.Lock()
+	if err == nil && c.changed {
+		c.commits++
+	}
+	c.changed = false
+	c.mu.Unlock()
+
+	return c.get().AfterTransaction(err)
+}
+
+func (c *changeListeners) Closed() error {
+	return c.get().Closed()
+}
@@ -0,0 +1,71 @@
+package boltimore_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/stretchr/testify/require"
+)
+
+// deleteRecorder records the paths of deletes it is notified of.
+type deleteRecorder struct {
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (r *deleteRecorder) paths() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.deleted...)
+}
+
+func (r *deleteRecorder) Opened(b *bolted.Bolted) error { return nil }
+func (r *deleteRecorder) Start(w bolted.WriteTx) error  { return nil }
+func (r *deleteRecorder) Delete(w bolted.WriteTx, path string) error {
+	r.mu.Lock()
+	r.deleted = append(r.deleted, path)
+	r.mu.Unlock()
+	return nil
+}
+func (r *deleteRecorder) CreateMap(w bolted.WriteTx, path string) error            { return nil }
+func (r *deleteRecorder) Put(w bolted.WriteTx, path string, newValue []byte) error { return nil }
+func (r *deleteRecorder) BeforeCommit(w bolted.WriteTx) error                      { return nil }
+func (r *deleteRecorder) AfterTransaction(err error) error                         { return nil }
+func (r *deleteRecorder) Closed() error                                            { return nil }
+
+func TestChangeListenerDeletes(t *testing.T) {
+	r := &deleteRecorder{}
+
+	b, err := boltimore.Open(t.TempDir(), boltimore.ChangeListener(r))
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Put("users/alice", []byte("alice"))
+		if err != nil {
+			return err
+		}
+
+		return tx.CreateMap("sessions")
+	})
+	require.NoError(t, err)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.Delete("users/alice")
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete("sessions")
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"users/alice", "sessions"}, r.paths())
+}
@@ -0,0 +1,195 @@
+// Package collection stores Go values of one type in a map of the database,
+// encoded with a codec and keyed by ID:
+//
+//	users := collection.New[User]("users", collection.JSON)
+//
+//	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+//		return users.Put(tx, "alice", User{Name: "Alice"})
+//	})
+package collection
+
+import (
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// ErrStop stops Iterate without failing when returned by its function.
+var ErrStop = errors.New("stop iteration")
+
+// Collection is the map at a path holding values of type T.
+type Collection[T any] struct {
+	path  string
+	codec Codec
+}
+
+// New returns the collection stored in the map at path. The map and its
+// parents are created by the first Put.
+func New[T any](path string, codec Codec) *Collection[T] {
+	return &Collection[T]{
+		path:  path,
+		codec: codec,
+	}
+}
+
+// Path returns the path of the map holding the collection.
+func (c *Collection[T]) Path() string {
+	return c.path
+}
+
+func (c *Collection[T]) itemPath(id string) string {
+	return dbpath.Append(c.path, id)
+}
+
+// Get returns the value with the id, ErrNotFound when there is none.
+func (c *Collection[T]) Get(tx bolted.ReadTx, id string) (T, error) {
+	var v T
+
+	ex, err := c.Has(tx, id)
+	if err != nil {
+		return v, err
+	}
+
+	if !ex {
+		return v, errors.Wrapf(ErrNotFound, "%s in %s", id, c.path)
+	}
+
+	d, err := tx.Get(c.itemPath(id))
+	if err != nil {
+		return v, err
+	}
+
+	err = c.codec.Unmarshal(d, &v)
+	if err != nil {
+		return v, errors.Wrapf(err, "while decoding %s in %s", id, c.path)
+	}
+
+	return v, nil
+}
+
+// Has returns whether there is a value with the id.
+func (c *Collection[T]) Has(tx bolted.ReadTx, id string) (bool, error) {
+	ex, err := paths.Exists(tx, c.path)
+	if err != nil || !ex {
+		return false, err
+	}
+
+	return tx.Exists(c.itemPath(id))
+}
+
+// Put stores the value under the id, replacing an existing one.
+func (c *Collection[T]) Put(tx bolted.WriteTx, id string, v T) error {
+	err := c.create(tx)
+	if err != nil {
+		return err
+	}
+
+	d, err := c.codec.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "while encoding %s in %s", id, c.path)
+	}
+
+	return tx.Put(c.itemPath(id), d)
+}
+
+// Delete removes the value with the id, ErrNotFound when there is none.
+// Change listeners, like indexes, are notified of the deletion.
+func (c *Collection[T]) Delete(tx bolted.WriteTx, id string) error {
+	ex, err := c.Has(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if !ex {
+		return errors.Wrapf(ErrNotFound, "%s in %s", id, c.path)
+	}
+
+	return tx.Delete(c.itemPath(id))
+}
+
+// Iterate calls fn for each value in the order of the IDs, until fn
+// returns an error. ErrStop stops the iteration without an error.
+func (c *Collection[T]) Iterate(tx bolted.ReadTx, fn func(id string, v T) error) error {
+	ex, err := paths.Exists(tx, c.path)
+	if err != nil || !ex {
+		return err
+	}
+
+	it, err := tx.Iterator(c.path)
+	if err != nil {
+		return err
+	}
+
+	for ; !it.Done; it.Next() {
+		if it.Value == nil {
+			// nested maps are not part of the collection
+			continue
+		}
+
+		var v T
+		err = c.codec.Unmarshal(it.Value, &v)
+		if err != nil {
+			return errors.Wrapf(err, "while decoding %s in %s", it.Key, c.path)
+		}
+
+		err = fn(it.Key, v)
+		if err == ErrStop {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Count returns the number of values in the collection.
+func (c *Collection[T]) Count(tx bolted.ReadTx) (int, error) {
+	ex, err := paths.Exists(tx, c.path)
+	if err != nil || !ex {
+		return 0, err
+	}
+
+	it, err := tx.Iterator(c.path)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for ; !it.Done; it.Next() {
+		if it.Value != nil {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (c *Collection[T]) create(tx bolted.WriteTx) error {
+	parts, err := dbpath.Split(c.path)
+	if err != nil {
+		return err
+	}
+
+	for i := range parts {
+		p := dbpath.Join(parts[:i+1]...)
+		ex, err := tx.Exists(p)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			err = tx.CreateMap(p)
+			if err != nil {
+				return errors.Wrapf(err, "while creating map %s", p)
+			}
+		}
+	}
+
+	return nil
+}
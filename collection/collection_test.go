@@ -0,0 +1,177 @@
+package collection_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/collection"
+	"github.com/draganm/boltimore/index"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type user struct {
+	Name  string
+	Email string
+	Roles []string
+}
+
+func openDB(t *testing.T) *bolted.Bolted {
+	db, err := bolted.Open(filepath.Join(t.TempDir(), "db"), 0700)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func TestCollection(t *testing.T) {
+	for name, codec := range map[string]collection.Codec{
+		"json":    collection.JSON,
+		"gob":     collection.Gob,
+		"msgpack": collection.Msgpack,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := openDB(t)
+			users := collection.New[user]("tenants/acme/users", codec)
+
+			alice := user{Name: "Alice", Email: "alice@example.com", Roles: []string{"admin"}}
+
+			t.Run("empty collection", func(t *testing.T) {
+				err := db.Read(func(tx bolted.ReadTx) error {
+					n, err := users.Count(tx)
+					require.NoError(t, err)
+					require.Equal(t, 0, n)
+
+					_, err = users.Get(tx, "alice")
+					require.Equal(t, collection.ErrNotFound, errors.Cause(err))
+
+					return users.Iterate(tx, func(id string, u user) error {
+						return errors.New("unexpected value")
+					})
+				})
+				require.NoError(t, err)
+			})
+
+			t.Run("put and get", func(t *testing.T) {
+				err := db.Write(func(tx bolted.WriteTx) error {
+					for i := 0; i < 5; i++ {
+						err := users.Put(tx, fmt.Sprintf("user%d", i), user{Name: fmt.Sprintf("User %d", i)})
+						if err != nil {
+							return err
+						}
+					}
+					return users.Put(tx, "alice", alice)
+				})
+				require.NoError(t, err)
+
+				err = db.Read(func(tx bolted.ReadTx) error {
+					u, err := users.Get(tx, "alice")
+					require.NoError(t, err)
+					require.Equal(t, alice, u)
+
+					n, err := users.Count(tx)
+					require.NoError(t, err)
+					require.Equal(t, 6, n)
+					return nil
+				})
+				require.NoError(t, err)
+			})
+
+			t.Run("iterate", func(t *testing.T) {
+				ids := []string{}
+				err := db.Read(func(tx bolted.ReadTx) error {
+					return users.Iterate(tx, func(id string, u user) error {
+						ids = append(ids, id)
+						if id == "user2" {
+							return collection.ErrStop
+						}
+						return nil
+					})
+				})
+				require.NoError(t, err)
+				require.Equal(t, []string{"alice", "user0", "user1", "user2"}, ids)
+			})
+
+			t.Run("delete", func(t *testing.T) {
+				err := db.Write(func(tx bolted.WriteTx) error {
+					return users.Delete(tx, "alice")
+				})
+				require.NoError(t, err)
+
+				err = db.Write(func(tx bolted.WriteTx) error {
+					return users.Delete(tx, "alice")
+				})
+				require.Equal(t, collection.ErrNotFound, errors.Cause(err))
+
+				err = db.Read(func(tx bolted.ReadTx) error {
+					ex, err := users.Has(tx, "alice")
+					require.NoError(t, err)
+					require.False(t, ex)
+					return nil
+				})
+				require.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestIndexedCollection(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir(), index.Define(index.Definition{
+		Name:   "usersByEmail",
+		Map:    "users",
+		Fields: []string{"Email"},
+		Unique: true,
+	}))
+	require.NoError(t, err)
+	defer b.Close()
+
+	users := collection.New[user]("users", collection.JSON)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return users.Put(tx, "alice", user{Name: "Alice", Email: "alice@example.com"})
+	})
+	require.NoError(t, err)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return users.Delete(tx, "alice")
+	})
+	require.NoError(t, err)
+
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		_, err := index.Get(tx, "usersByEmail", "alice@example.com")
+		require.Equal(t, index.ErrNotFound, errors.Cause(err))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// the email can be used again
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return users.Put(tx, "alice2", user{Name: "Alice", Email: "alice@example.com"})
+	})
+	require.NoError(t, err)
+}
+
+func TestCollectionDecodingError(t *testing.T) {
+	db := openDB(t)
+
+	err := db.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+		return tx.Put("users/broken", []byte("{"))
+	})
+	require.NoError(t, err)
+
+	users := collection.New[user]("users", collection.JSON)
+
+	err = db.Read(func(tx bolted.ReadTx) error {
+		_, err := users.Get(tx, "broken")
+		return err
+	})
+	require.Error(t, err)
+}
@@ -5,23 +5,73 @@ import (
 	"time"
 
 	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/clock/clocktest"
 	"github.com/stretchr/testify/require"
 )
 
 func TestCron(t *testing.T) {
-	waitChan := make(chan bool)
-
-	b, err := boltimore.Open(t.TempDir(), boltimore.CronFunction("@every 1s", func(cfc *boltimore.CronFunctionContext) {
-		close(waitChan)
-	}))
-	require.NoError(t, err)
-	defer b.Close()
-
-	select {
-	case <-waitChan:
-		// this will happen when the cron function closes the channel
-	case <-time.NewTimer(3 * time.Second).C:
-		require.Fail(t, "timed out waiting for execution")
-	}
+	t.Run("executes when the schedule is due", func(t *testing.T) {
+		waitChan := make(chan bool)
+
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.CronFunction("@every 1m", func(cfc *boltimore.CronFunctionContext) {
+				close(waitChan)
+			}),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		fc.BlockUntil(1)
+
+		fc.Advance(59 * time.Second)
+		select {
+		case <-waitChan:
+			require.Fail(t, "executed before the schedule was due")
+		default:
+		}
+
+		fc.Advance(time.Second)
+		select {
+		case <-waitChan:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "not executed when the schedule was due")
+		}
+	})
+
+	t.Run("passes the clock to the cron function", func(t *testing.T) {
+		nowChan := make(chan time.Time, 1)
+
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		fc := clocktest.NewFake(start)
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.CronFunction("0 * * * *", func(cfc *boltimore.CronFunctionContext) {
+				nowChan <- cfc.Clock.Now()
+			}),
+			boltimore.Clock(fc),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		fc.BlockUntil(1)
+		fc.Advance(time.Hour)
+
+		select {
+		case now := <-nowChan:
+			require.Equal(t, start.Add(time.Hour), now)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "not executed when the schedule was due")
+		}
+	})
+
+	t.Run("invalid schedule", func(t *testing.T) {
+		_, err := boltimore.Open(t.TempDir(), boltimore.CronFunction("not a schedule", func(cfc *boltimore.CronFunctionContext) {}))
+		require.Error(t, err)
+	})
 
 }
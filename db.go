@@ -0,0 +1,88 @@
+package boltimore
+
+import (
+	"sync"
+
+	"github.com/draganm/bolted"
+)
+
+// Database is implemented by DB and by bolted.Bolted.
+type Database interface {
+	Read(fn func(tx bolted.ReadTx) error) error
+	Write(fn func(tx bolted.WriteTx) error) error
+}
+
+// DB is the database of a Boltimore instance. It stays valid when the
+// database file is replaced by RestoreRaw or ReplaceStaged: transactions
+// started afterwards use the new database.
+// Transactions must not be nested, because the database can't be replaced
+// while a transaction is in progress.
+// bolted notifies change listeners of deleted maps, but not of deleted
+// values. Transactions of databases opened by Open notify the watcher and
+// the listeners added by ChangeListener of both.
+type DB struct {
+	mu      *sync.RWMutex
+	db      *bolted.Bolted
+	deletes bolted.ChangeListener
+}
+
+func newDB(db *bolted.Bolted) *DB {
+	return &DB{
+		mu: new(sync.RWMutex),
+		db: db,
+	}
+}
+
+func (d *DB) Read(fn func(tx bolted.ReadTx) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.read(fn)
+}
+
+func (d *DB) Write(fn func(tx bolted.WriteTx) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.write(fn)
+}
+
+// read and write don't lock mu, they are used while the database is
+// replaced.
+func (d *DB) read(fn func(tx bolted.ReadTx) error) error {
+	return d.db.Read(fn)
+}
+
+func (d *DB) write(fn func(tx bolted.WriteTx) error) error {
+	if d.deletes == nil {
+		return d.db.Write(fn)
+	}
+
+	return d.db.Write(func(tx bolted.WriteTx) error {
+		return fn(notifyingWriteTx{WriteTx: tx, deletes: d.deletes})
+	})
+}
+
+func (d *DB) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.db.Close()
+}
+
+// notifyingWriteTx notifies deletes of deleted values.
+type notifyingWriteTx struct {
+	bolted.WriteTx
+	deletes bolted.ChangeListener
+}
+
+func (tx notifyingWriteTx) Delete(pth string) error {
+	isMap, err := tx.IsMap(pth)
+	if err != nil {
+		return err
+	}
+
+	err = tx.WriteTx.Delete(pth)
+	if err != nil || isMap {
+		return err
+	}
+
+	return tx.deletes.Delete(tx.WriteTx, pth)
+}
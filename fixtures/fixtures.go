@@ -0,0 +1,273 @@
+// Package fixtures loads and exports YAML or JSON documents describing a tree
+// of maps and values. Mappings are created as maps, strings are stored as their
+// UTF-8 bytes and other scalars and sequences are stored JSON encoded.
+// A mapping with the single key "$base64" or "$json" is a value:
+//
+//	users:
+//	  alice: '{"name": "Alice"}'
+//	  bob:
+//	    $json: {name: Bob}
+//	  avatar:
+//	    $base64: AQID
+//
+// Maps with the single key "$base64" or "$json" can't be exported, they
+// would be loaded as values.
+package fixtures
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	base64Key = "$base64"
+	jsonKey   = "$json"
+)
+
+type Format int
+
+const (
+	JSON Format = iota
+	YAML
+)
+
+// FormatForFile returns YAML for files ending in .yaml or .yml and JSON otherwise.
+func FormatForFile(fileName string) Format {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return YAML
+	default:
+		return JSON
+	}
+}
+
+// InitFunction loads the fixture file into the root of the database.
+func InitFunction(fileName string) func(ifc *boltimore.InitFunctionContext) error {
+	return func(ifc *boltimore.InitFunctionContext) error {
+		return ifc.DB.Write(func(tx bolted.WriteTx) error {
+			return LoadFile(tx, "", fileName)
+		})
+	}
+}
+
+func LoadFile(tx bolted.WriteTx, root, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = Load(tx, root, f)
+	if err != nil {
+		return errors.Wrapf(err, "while loading %s", fileName)
+	}
+
+	return nil
+}
+
+// Load writes the fixture read from r under the root map.
+// Existing maps are kept and existing values are overwritten.
+func Load(tx bolted.WriteTx, root string, r io.Reader) error {
+	doc := &yaml.Node{}
+	err := yaml.NewDecoder(r).Decode(doc)
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "while parsing fixture")
+	}
+
+	if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return errors.New("fixture must be a mapping")
+	}
+
+	return loadMap(tx, root, doc.Content[0])
+}
+
+func loadMap(tx bolted.WriteTx, pth string, n *yaml.Node) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := n.Content[i].Value
+		child := n.Content[i+1]
+		childPath := dbpath.Append(pth, key)
+
+		if child.Kind == yaml.AliasNode {
+			child = child.Alias
+		}
+
+		if child.Kind == yaml.MappingNode && !isValueMapping(child) {
+			ex, err := tx.Exists(childPath)
+			if err != nil {
+				return err
+			}
+
+			if !ex {
+				err = tx.CreateMap(childPath)
+				if err != nil {
+					return errors.Wrapf(err, "while creating map %s", childPath)
+				}
+			}
+
+			err = loadMap(tx, childPath, child)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		v, err := value(child)
+		if err != nil {
+			return errors.Wrapf(err, "while reading value of %s", childPath)
+		}
+
+		err = tx.Put(childPath, v)
+		if err != nil {
+			return errors.Wrapf(err, "while writing %s", childPath)
+		}
+	}
+
+	return nil
+}
+
+func isValueMapping(n *yaml.Node) bool {
+	if len(n.Content) != 2 {
+		return false
+	}
+	k := n.Content[0].Value
+	return k == base64Key || k == jsonKey
+}
+
+func value(n *yaml.Node) ([]byte, error) {
+	if n.Kind == yaml.MappingNode {
+		switch n.Content[0].Value {
+		case base64Key:
+			return base64.StdEncoding.DecodeString(n.Content[1].Value)
+		default:
+			return jsonValue(n.Content[1])
+		}
+	}
+
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return nil, errors.New("null values are not supported")
+	}
+
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" {
+		return []byte(n.Value), nil
+	}
+
+	return jsonValue(n)
+}
+
+func jsonValue(n *yaml.Node) ([]byte, error) {
+	var v interface{}
+	err := n.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func ExportFile(tx bolted.ReadTx, root, fileName string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	err = Export(tx, root, f, FormatForFile(fileName))
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "while exporting to %s", fileName)
+	}
+
+	return f.Close()
+}
+
+// Export writes the content of the root map as a fixture that can be read by Load.
+// Values that are not valid UTF-8 are exported base64 encoded.
+func Export(tx bolted.ReadTx, root string, w io.Writer, format Format) error {
+	tree, err := ExportTree(tx, root)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case YAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		err = enc.Encode(tree)
+		if err != nil {
+			return err
+		}
+		return enc.Close()
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tree)
+	default:
+		return errors.Errorf("unsupported format %d", format)
+	}
+}
+
+// ExportTree returns the content of the root map as nested maps of the
+// values written by Export.
+func ExportTree(tx bolted.ReadTx, root string) (map[string]interface{}, error) {
+	return exportMap(tx, root)
+}
+
+func exportMap(tx bolted.ReadTx, pth string) (map[string]interface{}, error) {
+	it, err := tx.Iterator(pth)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while creating iterator for %s", pth)
+	}
+
+	m := map[string]interface{}{}
+
+	for ; !it.Done; it.Next() {
+		if it.Value == nil {
+			childPath := dbpath.Append(pth, it.Key)
+			child, err := exportMap(tx, childPath)
+			if err != nil {
+				return nil, err
+			}
+
+			if isValueMap(child) {
+				return nil, errors.Errorf("map %s can't be exported, it would be loaded as a value", childPath)
+			}
+
+			m[it.Key] = child
+			continue
+		}
+
+		m[it.Key] = exportValue(it.Value)
+	}
+
+	return m, nil
+}
+
+// isValueMap returns true for maps that look like encoded values.
+func isValueMap(m map[string]interface{}) bool {
+	if len(m) != 1 {
+		return false
+	}
+	_, isBase64 := m[base64Key]
+	_, isJSON := m[jsonKey]
+	return isBase64 || isJSON
+}
+
+func exportValue(v []byte) interface{} {
+	if utf8.Valid(v) {
+		return string(v)
+	}
+	return map[string]string{base64Key: base64.StdEncoding.EncodeToString(v)}
+}
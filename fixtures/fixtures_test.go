@@ -0,0 +1,138 @@
+package fixtures_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/fixtures"
+	"github.com/stretchr/testify/require"
+)
+
+const fixture = `
+users:
+  alice: '{"name": "Alice"}'
+  bob:
+    $json: {name: Bob}
+  avatar:
+    $base64: AQID
+  empty: {}
+counter: 42
+enabled: true
+tags: [a, b]
+`
+
+func get(t *testing.T, b *boltimore.Boltimore, pth string) []byte {
+	var v []byte
+	err := b.DB.Read(func(tx bolted.ReadTx) error {
+		var err error
+		v, err = tx.Get(pth)
+		return err
+	})
+	require.NoError(t, err)
+	return v
+}
+
+func TestLoadAndExport(t *testing.T) {
+	dir := t.TempDir()
+	fixtureFile := filepath.Join(dir, "fixture.yaml")
+	err := ioutil.WriteFile(fixtureFile, []byte(fixture), 0600)
+	require.NoError(t, err)
+
+	b, err := boltimore.Open(t.TempDir(), boltimore.InitFunction(fixtures.InitFunction(fixtureFile)))
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.Equal(t, []byte(`{"name": "Alice"}`), get(t, b, "users/alice"))
+	require.Equal(t, []byte(`{"name":"Bob"}`), get(t, b, "users/bob"))
+	require.Equal(t, []byte{1, 2, 3}, get(t, b, "users/avatar"))
+	require.Equal(t, []byte("42"), get(t, b, "counter"))
+	require.Equal(t, []byte("true"), get(t, b, "enabled"))
+	require.Equal(t, []byte(`["a","b"]`), get(t, b, "tags"))
+
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		isMap, err := tx.IsMap("users/empty")
+		require.True(t, isMap)
+		return err
+	})
+	require.NoError(t, err)
+
+	for _, format := range []fixtures.Format{fixtures.JSON, fixtures.YAML} {
+		exported := new(bytes.Buffer)
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			return fixtures.Export(tx, "users", exported, format)
+		})
+		require.NoError(t, err)
+
+		b2, err := boltimore.Open(t.TempDir())
+		require.NoError(t, err)
+
+		err = b2.DB.Write(func(tx bolted.WriteTx) error {
+			err = tx.CreateMap("copy")
+			if err != nil {
+				return err
+			}
+			return fixtures.Load(tx, "copy", exported)
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []byte(`{"name": "Alice"}`), get(t, b2, "copy/alice"))
+		require.Equal(t, []byte(`{"name":"Bob"}`), get(t, b2, "copy/bob"))
+		require.Equal(t, []byte{1, 2, 3}, get(t, b2, "copy/avatar"))
+
+		require.NoError(t, b2.Close())
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return fixtures.Load(tx, "", strings.NewReader(`{"foo": {"bar": "baz", "bin": {"$base64": "/w=="}}}`))
+	})
+	require.NoError(t, err)
+
+	exported := new(bytes.Buffer)
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		return fixtures.Export(tx, "", exported, fixtures.JSON)
+	})
+	require.NoError(t, err)
+
+	require.JSONEq(t, `{"foo": {"bar": "baz", "bin": {"$base64": "/w=="}}}`, exported.String())
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("foo/map")
+		if err != nil {
+			return err
+		}
+		return tx.Put("foo/map/$json", []byte("{}"))
+	})
+	require.NoError(t, err)
+
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		return fixtures.Export(tx, "", new(bytes.Buffer), fixtures.JSON)
+	})
+	require.EqualError(t, err, "map foo/map can't be exported, it would be loaded as a value")
+}
+
+func TestLoadErrors(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return fixtures.Load(tx, "", strings.NewReader(`[1, 2]`))
+	})
+	require.EqualError(t, err, "fixture must be a mapping")
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		return fixtures.Load(tx, "", strings.NewReader(`foo: null`))
+	})
+	require.EqualError(t, err, "while reading value of foo: null values are not supported")
+}
@@ -0,0 +1,591 @@
+// Package index maintains secondary indexes of maps holding JSON objects.
+// The indexes are updated by a change listener in the transaction writing
+// the records:
+//
+//	boltimore.Open(dir,
+//		index.Define(index.Definition{
+//			Name:   "usersByEmail",
+//			Map:    "users",
+//			Fields: []string{"email"},
+//			Unique: true,
+//		}),
+//	)
+//
+//	id, err := index.Get(tx, "usersByEmail", "alice@example.com")
+package index
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+// __indexes/<name>/definition          JSON of the definition
+// __indexes/<name>/entries/<key>/<id>  ID of each record with the key
+// __indexes/<name>/records/<id>        key of each indexed record
+const (
+	indexesMapName = "__indexes"
+	definitionKey  = "definition"
+	entriesMapName = "entries"
+	recordsMapName = "records"
+	nameParameter  = "name"
+)
+
+func init() {
+	// the indexes are rebuilt when the database is opened
+	boltimore.RegisterInternalMap(indexesMapName, false)
+}
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrUnknownIndex    = errors.New("unknown index")
+	ErrUniqueViolation = errors.New("unique index violation")
+)
+
+// Definition describes an index of the records in Map, which are JSON
+// objects keyed by their ID.
+type Definition struct {
+	Name string `json:"name"`
+	Map  string `json:"map"`
+	// Fields are the fields of the records making up the key, nested fields
+	// are separated by dots, like "address.city". Records missing one of
+	// the fields are not indexed.
+	Fields []string `json:"fields"`
+	// Unique rejects writing a record with the key of another record.
+	Unique bool `json:"unique"`
+}
+
+func (d Definition) validate() (Definition, error) {
+	if d.Name == "" {
+		return d, errors.New("index name is empty")
+	}
+
+	if len(d.Fields) == 0 {
+		return d, errors.Errorf("index %s has no fields", d.Name)
+	}
+
+	parts, err := dbpath.Split(d.Map)
+	if err != nil {
+		return d, errors.Wrapf(err, "while parsing map of index %s", d.Name)
+	}
+
+	if len(parts) == 0 || parts[0] == indexesMapName {
+		return d, errors.Errorf("index %s can't index map %q", d.Name, d.Map)
+	}
+
+	d.Map = dbpath.Join(parts...)
+	return d, nil
+}
+
+// key returns the key of the record, false when it is not indexed.
+func (d Definition) key(value []byte) (string, bool, error) {
+	record := map[string]interface{}{}
+	err := json.Unmarshal(value, &record)
+	if err != nil {
+		return "", false, errors.Wrap(err, "while parsing record")
+	}
+
+	values := []interface{}{}
+	for _, f := range d.Fields {
+		var v interface{} = record
+		for _, p := range strings.Split(f, ".") {
+			m, isObject := v.(map[string]interface{})
+			if !isObject {
+				return "", false, nil
+			}
+
+			v, isObject = m[p]
+			if !isObject {
+				return "", false, nil
+			}
+		}
+		values = append(values, v)
+	}
+
+	key, err := encodeKey(values)
+	if err != nil {
+		return "", false, err
+	}
+
+	return key, true, nil
+}
+
+// Define adds the indexes and an index listener to the database.
+// Indexes that don't exist yet or whose definition has changed are built
+// from the existing records, also when the database file is replaced by a
+// restore.
+func Define(defs ...Definition) boltimore.Option {
+	return func(b *boltimore.Boltimore) error {
+		l := &listener{}
+
+		for _, d := range defs {
+			d, err := d.validate()
+			if err != nil {
+				return err
+			}
+			l.defs = append(l.defs, d)
+		}
+
+		return boltimore.ChangeListener(l)(b)
+	}
+}
+
+// Rebuild rebuilds the index from the records.
+func Rebuild(tx bolted.WriteTx, name string) error {
+	d, err := readDefinition(tx, name)
+	if err != nil {
+		return err
+	}
+
+	return build(tx, *d)
+}
+
+// RebuildEndpoint rebuilds the index named by the name query parameter, or
+// all indexes without it, and responds with the names of the rebuilt indexes.
+func RebuildEndpoint(rc *boltimore.RequestContext) error {
+	name := rc.Request.URL.Query().Get(nameParameter)
+	rebuilt := []string{}
+
+	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+		names := []string{name}
+		if name == "" {
+			var err error
+			names, err = indexNames(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, n := range names {
+			err := Rebuild(tx, n)
+			if err != nil {
+				return errors.Wrapf(err, "while rebuilding index %s", n)
+			}
+			rebuilt = append(rebuilt, n)
+		}
+		return nil
+	})
+
+	if errors.Cause(err) == ErrUnknownIndex {
+		return rc.RespondWithError(err.Error(), 404)
+	}
+
+	if errors.Cause(err) == ErrUniqueViolation {
+		return rc.RespondWithError(err.Error(), 409)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithJSON(map[string]interface{}{
+		"rebuilt": rebuilt,
+	})
+}
+
+func indexNames(tx bolted.ReadTx) ([]string, error) {
+	names := []string{}
+
+	ex, err := tx.Exists(indexesMapName)
+	if err != nil || !ex {
+		return names, err
+	}
+
+	it, err := tx.Iterator(indexesMapName)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; !it.Done; it.Next() {
+		names = append(names, it.Key)
+	}
+
+	return names, nil
+}
+
+func readDefinition(tx bolted.ReadTx, name string) (*Definition, error) {
+	pth := dbpath.Join(indexesMapName, name, definitionKey)
+
+	for _, p := range []string{indexesMapName, dbpath.Join(indexesMapName, name), pth} {
+		ex, err := tx.Exists(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ex {
+			return nil, errors.Wrap(ErrUnknownIndex, name)
+		}
+	}
+
+	v, err := tx.Get(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Definition{}
+	err = json.Unmarshal(v, d)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing definition of index %s", name)
+	}
+
+	return d, nil
+}
+
+// ensureIndex creates the maps and the definition of the index, which are
+// missing after the index has been deleted, for example by a restore.
+func ensureIndex(tx bolted.WriteTx, d Definition) error {
+	indexPath := dbpath.Join(indexesMapName, d.Name)
+
+	for _, m := range []string{
+		indexesMapName,
+		indexPath,
+		dbpath.Join(indexesMapName, d.Name, entriesMapName),
+		dbpath.Join(indexesMapName, d.Name, recordsMapName),
+	} {
+		ex, err := tx.Exists(m)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			err = tx.CreateMap(m)
+			if err != nil {
+				return errors.Wrapf(err, "while creating map %s", m)
+			}
+		}
+	}
+
+	ex, err := tx.Exists(dbpath.Append(indexPath, definitionKey))
+	if err != nil || ex {
+		return err
+	}
+
+	dd, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(dbpath.Append(indexPath, definitionKey), dd)
+}
+
+// build replaces the index with one built from the records.
+func build(tx bolted.WriteTx, d Definition) error {
+	indexPath := dbpath.Join(indexesMapName, d.Name)
+
+	ex, err := tx.Exists(indexesMapName)
+	if err != nil {
+		return err
+	}
+
+	if ex {
+		ex, err = tx.Exists(indexPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ex {
+		err = tx.Delete(indexPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ensureIndex(tx, d)
+	if err != nil {
+		return err
+	}
+
+	found, err := paths.IsMap(tx, d.Map)
+	if err != nil || !found {
+		return err
+	}
+
+	it, err := tx.Iterator(d.Map)
+	if err != nil {
+		return err
+	}
+
+	records := map[string][]byte{}
+	for ; !it.Done; it.Next() {
+		if it.Value != nil {
+			records[it.Key] = append([]byte(nil), it.Value...)
+		}
+	}
+
+	for id, v := range records {
+		err = updateRecord(tx, d, id, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateRecord moves the record to the entry of its current key.
+func updateRecord(tx bolted.WriteTx, d Definition, id string, value []byte) error {
+	err := ensureIndex(tx, d)
+	if err != nil {
+		return err
+	}
+
+	key, indexed, err := d.key(value)
+	if err != nil {
+		return errors.Wrapf(err, "while indexing %s in %s", id, d.Map)
+	}
+
+	oldKey, wasIndexed, err := recordKey(tx, d, id)
+	if err != nil {
+		return err
+	}
+
+	if indexed && wasIndexed && key == oldKey {
+		return nil
+	}
+
+	if wasIndexed {
+		err = removeEntry(tx, d, oldKey, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	recordPath := dbpath.Join(indexesMapName, d.Name, recordsMapName, id)
+
+	if !indexed {
+		if wasIndexed {
+			return tx.Delete(recordPath)
+		}
+		return nil
+	}
+
+	entryPath := dbpath.Join(indexesMapName, d.Name, entriesMapName, key)
+
+	ex, err := tx.Exists(entryPath)
+	if err != nil {
+		return err
+	}
+
+	if !ex {
+		err = tx.CreateMap(entryPath)
+		if err != nil {
+			return err
+		}
+	} else if d.Unique {
+		it, err := tx.Iterator(entryPath)
+		if err != nil {
+			return err
+		}
+
+		if !it.Done && it.Key != id {
+			values, _ := decodeKey(key)
+			return errors.Wrapf(ErrUniqueViolation, "%s: %s and %s in %s have the key %v", d.Name, it.Key, id, d.Map, values)
+		}
+	}
+
+	err = tx.Put(dbpath.Append(entryPath, id), []byte(id))
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(recordPath, []byte(key))
+}
+
+func removeRecord(tx bolted.WriteTx, d Definition, id string) error {
+	key, indexed, err := recordKey(tx, d, id)
+	if err != nil || !indexed {
+		return err
+	}
+
+	err = removeEntry(tx, d, key, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Delete(dbpath.Join(indexesMapName, d.Name, recordsMapName, id))
+}
+
+func recordKey(tx bolted.ReadTx, d Definition, id string) (string, bool, error) {
+	pth := dbpath.Join(indexesMapName, d.Name, recordsMapName, id)
+
+	ex, err := tx.Exists(pth)
+	if err != nil || !ex {
+		return "", false, err
+	}
+
+	v, err := tx.Get(pth)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(v), true, nil
+}
+
+func removeEntry(tx bolted.WriteTx, d Definition, key, id string) error {
+	entryPath := dbpath.Join(indexesMapName, d.Name, entriesMapName, key)
+
+	err := tx.Delete(dbpath.Append(entryPath, id))
+	if err != nil {
+		return errors.Wrapf(err, "while removing %s from index %s", id, d.Name)
+	}
+
+	it, err := tx.Iterator(entryPath)
+	if err != nil {
+		return err
+	}
+
+	if it.Done {
+		return tx.Delete(entryPath)
+	}
+
+	return nil
+}
+
+// listener updates the indexes when records are written.
+type listener struct {
+	defs []Definition
+}
+
+// affected returns the definitions indexing the map at pth.
+func (l *listener) affected(pth string) ([]Definition, error) {
+	parts, err := dbpath.Split(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 || parts[0] == indexesMapName {
+		return nil, nil
+	}
+
+	m := dbpath.Join(parts...)
+	defs := []Definition{}
+	for _, d := range l.defs {
+		if d.Map == m {
+			defs = append(defs, d)
+		}
+	}
+
+	return defs, nil
+}
+
+func splitRecordPath(pth string) (string, string, error) {
+	parts, err := dbpath.Split(pth)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(parts) == 0 {
+		return "", "", nil
+	}
+
+	return dbpath.Join(parts[:len(parts)-1]...), parts[len(parts)-1], nil
+}
+
+// Opened builds the missing and changed indexes when the listener is added
+// and when the database is reopened.
+func (l *listener) Opened(b *bolted.Bolted) error {
+	return b.Write(func(tx bolted.WriteTx) error {
+		for _, d := range l.defs {
+			stored, err := readDefinition(tx, d.Name)
+			if err != nil && errors.Cause(err) != ErrUnknownIndex {
+				return err
+			}
+
+			if stored != nil && reflect.DeepEqual(*stored, d) {
+				continue
+			}
+
+			err = build(tx, d)
+			if err != nil {
+				return errors.Wrapf(err, "while building index %s", d.Name)
+			}
+		}
+		return nil
+	})
+}
+
+func (l *listener) Start(w bolted.WriteTx) error {
+	return nil
+}
+
+func (l *listener) Delete(w bolted.WriteTx, path string) error {
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return err
+	}
+
+	deleted := dbpath.Join(parts...)
+
+	for _, d := range l.defs {
+		// the indexed map or one of its parents has been deleted
+		if d.Map == deleted || strings.HasPrefix(d.Map, deleted+dbpath.Separator) {
+			err = build(w, d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	parent, id, err := splitRecordPath(path)
+	if err != nil {
+		return err
+	}
+
+	defs, err := l.affected(parent)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range defs {
+		err = removeRecord(w, d, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *listener) CreateMap(w bolted.WriteTx, path string) error {
+	return nil
+}
+
+func (l *listener) Put(w bolted.WriteTx, path string, newValue []byte) error {
+	parent, id, err := splitRecordPath(path)
+	if err != nil {
+		return err
+	}
+
+	defs, err := l.affected(parent)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range defs {
+		err = updateRecord(w, d, id, newValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *listener) BeforeCommit(w bolted.WriteTx) error {
+	return nil
+}
+
+func (l *listener) AfterTransaction(err error) error {
+	return nil
+}
+
+func (l *listener) Closed() error {
+	return nil
+}
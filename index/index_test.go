@@ -0,0 +1,368 @@
+package index_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/draganm/boltimore/index"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type user struct {
+	Email   string  `json:"email,omitempty"`
+	Team    string  `json:"team"`
+	Age     float64 `json:"age"`
+	Address struct {
+		City string `json:"city,omitempty"`
+	} `json:"address"`
+}
+
+var definitions = []index.Definition{
+	{
+		Name:   "usersByEmail",
+		Map:    "users",
+		Fields: []string{"email"},
+		Unique: true,
+	},
+	{
+		Name:   "usersByTeamAndAge",
+		Map:    "users",
+		Fields: []string{"team", "age"},
+	},
+	{
+		Name:   "usersByCity",
+		Map:    "users",
+		Fields: []string{"address.city"},
+	},
+}
+
+func putUser(tx bolted.WriteTx, id string, u user) error {
+	d, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return tx.Put("users/"+id, d)
+}
+
+func TestIndexes(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := boltimore.Open(dir, index.Define(definitions...), boltimore.Endpoint("POST", "/rebuild", index.RebuildEndpoint))
+	require.NoError(t, err)
+	defer func() {
+		b.Close()
+	}()
+
+	alice := user{Email: "alice@example.com", Team: "red", Age: 30}
+	alice.Address.City = "Berlin"
+	bob := user{Email: "bob@example.com", Team: "red", Age: 25}
+	carol := user{Email: "carol@example.com", Team: "blue", Age: 41}
+	carol.Address.City = "Berlin"
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+
+		for id, u := range map[string]user{"alice": alice, "bob": bob, "carol": carol} {
+			err = putUser(tx, id, u)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	read := func(fn func(tx bolted.ReadTx)) {
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			fn(tx)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	scan := func(tx bolted.ReadTx, from, to []interface{}) []string {
+		ids := []string{}
+		err := index.Scan(tx, "usersByTeamAndAge", from, to, func(key []interface{}, id string) error {
+			ids = append(ids, id)
+			return nil
+		})
+		require.NoError(t, err)
+		return ids
+	}
+
+	t.Run("lookup", func(t *testing.T) {
+		read(func(tx bolted.ReadTx) {
+			id, err := index.Get(tx, "usersByEmail", "bob@example.com")
+			require.NoError(t, err)
+			require.Equal(t, "bob", id)
+
+			_, err = index.Get(tx, "usersByEmail", "dave@example.com")
+			require.Equal(t, index.ErrNotFound, errors.Cause(err))
+
+			ids, err := index.Lookup(tx, "usersByCity", "Berlin")
+			require.NoError(t, err)
+			require.Equal(t, []string{"alice", "carol"}, ids)
+
+			ids, err = index.Lookup(tx, "usersByTeamAndAge", "red", 30)
+			require.NoError(t, err)
+			require.Equal(t, []string{"alice"}, ids)
+
+			_, err = index.Lookup(tx, "unknown", "x")
+			require.Equal(t, index.ErrUnknownIndex, errors.Cause(err))
+		})
+	})
+
+	t.Run("range scan", func(t *testing.T) {
+		read(func(tx bolted.ReadTx) {
+			require.Equal(t, []string{"carol", "bob", "alice"}, scan(tx, nil, nil))
+			require.Equal(t, []string{"bob", "alice"}, scan(tx, []interface{}{"red"}, nil))
+			require.Equal(t, []string{"bob"}, scan(tx, []interface{}{"red"}, []interface{}{"red", 30}))
+			require.Equal(t, []string{"carol"}, scan(tx, nil, []interface{}{"red"}))
+
+			keys := [][]interface{}{}
+			err := index.ScanPrefix(tx, "usersByTeamAndAge", []interface{}{"red"}, func(key []interface{}, id string) error {
+				keys = append(keys, key)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, [][]interface{}{{"red", 25.0}, {"red", 30.0}}, keys)
+		})
+	})
+
+	t.Run("updating a record", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			bob.Team = "blue"
+			bob.Address.City = "Paris"
+			return putUser(tx, "bob", bob)
+		})
+		require.NoError(t, err)
+
+		read(func(tx bolted.ReadTx) {
+			require.Equal(t, []string{"bob", "carol", "alice"}, scan(tx, nil, nil))
+
+			ids, err := index.Lookup(tx, "usersByCity", "Paris")
+			require.NoError(t, err)
+			require.Equal(t, []string{"bob"}, ids)
+		})
+	})
+
+	t.Run("unique violation", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			return putUser(tx, "mallory", user{Email: "alice@example.com"})
+		})
+		require.Equal(t, index.ErrUniqueViolation, errors.Cause(err))
+
+		read(func(tx bolted.ReadTx) {
+			ex, err := tx.Exists("users/mallory")
+			require.NoError(t, err)
+			require.False(t, ex)
+		})
+	})
+
+	t.Run("deleting a record", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Delete("users/alice")
+		})
+		require.NoError(t, err)
+
+		read(func(tx bolted.ReadTx) {
+			_, err := index.Get(tx, "usersByEmail", "alice@example.com")
+			require.Equal(t, index.ErrNotFound, errors.Cause(err))
+
+			ids, err := index.Lookup(tx, "usersByCity", "Berlin")
+			require.NoError(t, err)
+			require.Equal(t, []string{"carol"}, ids)
+		})
+	})
+
+	t.Run("rebuild", func(t *testing.T) {
+		// records written without the listener are only indexed by a rebuild
+		require.NoError(t, b.Close())
+
+		db, err := bolted.Open(dir+"/db", 0700)
+		require.NoError(t, err)
+		err = db.Write(func(tx bolted.WriteTx) error {
+			return putUser(tx, "dave", user{Email: "dave@example.com", Team: "green"})
+		})
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+
+		b, err = boltimore.Open(dir, index.Define(definitions...), boltimore.Endpoint("POST", "/rebuild", index.RebuildEndpoint))
+		require.NoError(t, err)
+
+		read(func(tx bolted.ReadTx) {
+			_, err := index.Get(tx, "usersByEmail", "dave@example.com")
+			require.Equal(t, index.ErrNotFound, errors.Cause(err))
+		})
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/rebuild?name=usersByEmail", nil))
+		require.Equal(t, 200, rec.Code)
+		require.JSONEq(t, `{"rebuilt":["usersByEmail"]}`, rec.Body.String())
+
+		read(func(tx bolted.ReadTx) {
+			id, err := index.Get(tx, "usersByEmail", "dave@example.com")
+			require.NoError(t, err)
+			require.Equal(t, "dave", id)
+		})
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/rebuild?name=unknown", nil))
+		require.Equal(t, 404, rec.Code)
+	})
+
+	t.Run("deleting the indexed map", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			return tx.Delete("users")
+		})
+		require.NoError(t, err)
+
+		read(func(tx bolted.ReadTx) {
+			require.Equal(t, []string{}, scan(tx, nil, nil))
+		})
+	})
+}
+
+func TestChangedDefinitionIsBuilt(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := boltimore.Open(dir, index.Define(index.Definition{Name: "usersByTeam", Map: "users", Fields: []string{"email"}}))
+	require.NoError(t, err)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+		return putUser(tx, "alice", user{Email: "alice@example.com", Team: "red"})
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	b, err = boltimore.Open(dir, index.Define(index.Definition{Name: "usersByTeam", Map: "users", Fields: []string{"team"}}))
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		id, err := index.Get(tx, "usersByTeam", "red")
+		require.NoError(t, err)
+		require.Equal(t, "alice", id)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	b, err := boltimore.Open(
+		t.TempDir(),
+		index.Define(definitions...),
+		backup.ChangeLog(),
+		boltimore.Endpoint("GET", "/backup", backup.BackupEndpoint),
+		boltimore.Endpoint("PUT", "/backup", backup.RestoreEndpoint),
+		backup.StagedRestoreEndpoints("/staged"),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+		return putUser(tx, "alice", user{Email: "alice@example.com"})
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/backup", nil))
+	require.Equal(t, 200, rec.Code)
+	dump := rec.Body.Bytes()
+
+	checkIndex := func(t *testing.T) {
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			id, err := index.Get(tx, "usersByEmail", "alice@example.com")
+			require.NoError(t, err)
+			require.Equal(t, "alice", id)
+
+			_, err = index.Get(tx, "usersByEmail", "bob@example.com")
+			require.Equal(t, index.ErrNotFound, errors.Cause(err))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	for _, endpoint := range []string{"/backup", "/staged"} {
+		t.Run(endpoint, func(t *testing.T) {
+			err := b.DB.Write(func(tx bolted.WriteTx) error {
+				err := tx.Delete("users/alice")
+				if err != nil {
+					return err
+				}
+				return putUser(tx, "bob", user{Email: "bob@example.com"})
+			})
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			b.ServeHTTP(rec, httptest.NewRequest("PUT", endpoint, bytes.NewReader(dump)))
+			require.Equal(t, 200, rec.Code, rec.Body.String())
+
+			checkIndex(t)
+		})
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir(), index.Define(index.Definition{Name: "byValue", Map: "values", Fields: []string{"v"}}))
+	require.NoError(t, err)
+	defer b.Close()
+
+	values := map[string]string{
+		"null":     `null`,
+		"false":    `false`,
+		"true":     `true`,
+		"negative": `-100.5`,
+		"zero":     `0`,
+		"small":    `2`,
+		"big":      `10`,
+		"empty":    `""`,
+		"a":        `"a"`,
+		"ab":       `"ab"`,
+		"b":        `"b"`,
+	}
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("values")
+		if err != nil {
+			return err
+		}
+		for id, v := range values {
+			err = tx.Put("values/"+id, []byte(`{"v":`+v+`}`))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		ids := []string{}
+		err := index.Scan(tx, "byValue", nil, nil, func(key []interface{}, id string) error {
+			ids = append(ids, id)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"null", "false", "true", "negative", "zero", "small", "big", "empty", "a", "ab", "b"}, ids)
+		return nil
+	})
+	require.NoError(t, err)
+}
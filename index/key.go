@@ -0,0 +1,165 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Index keys are encoded so that their byte order is the order of their
+// values: null < false < true < numbers < strings < other JSON values.
+const (
+	tagNull   = 0x01
+	tagFalse  = 0x02
+	tagTrue   = 0x03
+	tagNumber = 0x04
+	tagString = 0x05
+	tagJSON   = 0x06
+)
+
+// normalizeValues converts Go values to the values of decoded JSON, so that
+// int(1) and float64(1) result in the same key.
+func normalizeValues(values []interface{}) ([]interface{}, error) {
+	d, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized := []interface{}{}
+	err = json.Unmarshal(d, &normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalized, nil
+}
+
+func encodeKey(values []interface{}) (string, error) {
+	values, err := normalizeValues(values)
+	if err != nil {
+		return "", errors.Wrap(err, "while encoding key")
+	}
+
+	b := &strings.Builder{}
+
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			b.WriteByte(tagNull)
+		case bool:
+			if v {
+				b.WriteByte(tagTrue)
+			} else {
+				b.WriteByte(tagFalse)
+			}
+		case float64:
+			b.WriteByte(tagNumber)
+			bits := math.Float64bits(v)
+			if v >= 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, bits)
+			b.Write(buf)
+		case string:
+			b.WriteByte(tagString)
+			writeEscaped(b, v)
+		default:
+			d, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			b.WriteByte(tagJSON)
+			writeEscaped(b, string(d))
+		}
+	}
+
+	return b.String(), nil
+}
+
+// writeEscaped writes the string with 0x00 escaped as 0x00 0xff, terminated
+// by 0x00 0x01, which sorts before any continuation of the string.
+func writeEscaped(b *strings.Builder, s string) {
+	b.WriteString(strings.Replace(s, "\x00", "\x00\xff", -1))
+	b.WriteString("\x00\x01")
+}
+
+func decodeKey(key string) ([]interface{}, error) {
+	values := []interface{}{}
+	d := []byte(key)
+
+	for len(d) > 0 {
+		tag := d[0]
+		d = d[1:]
+
+		switch tag {
+		case tagNull:
+			values = append(values, nil)
+		case tagFalse:
+			values = append(values, false)
+		case tagTrue:
+			values = append(values, true)
+		case tagNumber:
+			if len(d) < 8 {
+				return nil, errors.New("truncated number")
+			}
+			bits := binary.BigEndian.Uint64(d[:8])
+			if bits&(1<<63) != 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			values = append(values, math.Float64frombits(bits))
+			d = d[8:]
+		case tagString, tagJSON:
+			s, rest, err := readEscaped(d)
+			if err != nil {
+				return nil, err
+			}
+			d = rest
+
+			if tag == tagString {
+				values = append(values, s)
+				continue
+			}
+
+			var v interface{}
+			err = json.Unmarshal([]byte(s), &v)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		default:
+			return nil, errors.Errorf("unknown key tag %d", tag)
+		}
+	}
+
+	return values, nil
+}
+
+func readEscaped(d []byte) (string, []byte, error) {
+	b := &bytes.Buffer{}
+	for i := 0; i < len(d)-1; i++ {
+		if d[i] != 0 {
+			b.WriteByte(d[i])
+			continue
+		}
+
+		switch d[i+1] {
+		case 0x01:
+			return b.String(), d[i+2:], nil
+		case 0xff:
+			b.WriteByte(0)
+			i++
+		default:
+			return "", nil, errors.New("invalid escape sequence")
+		}
+	}
+	return "", nil, errors.New("unterminated string")
+}
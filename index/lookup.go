@@ -0,0 +1,148 @@
+package index
+
+import (
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/pkg/errors"
+)
+
+// ErrStop stops a scan without failing when returned by its function.
+var ErrStop = errors.New("stop scan")
+
+// Lookup returns the IDs of the records with the key made of the values
+// of all fields of the index, in the order of the IDs.
+func Lookup(tx bolted.ReadTx, name string, values ...interface{}) ([]string, error) {
+	d, err := readDefinition(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) != len(d.Fields) {
+		return nil, errors.Errorf("index %s has %d fields, got %d values", name, len(d.Fields), len(values))
+	}
+
+	key, err := encodeKey(values)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+
+	entryPath := dbpath.Join(indexesMapName, name, entriesMapName, key)
+	ex, err := tx.Exists(entryPath)
+	if err != nil || !ex {
+		return ids, err
+	}
+
+	it, err := tx.Iterator(entryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; !it.Done; it.Next() {
+		ids = append(ids, it.Key)
+	}
+
+	return ids, nil
+}
+
+// Get returns the ID of the record with the key, ErrNotFound when there is
+// none. It is meant for unique indexes, the first ID is returned otherwise.
+func Get(tx bolted.ReadTx, name string, values ...interface{}) (string, error) {
+	ids, err := Lookup(tx, name, values...)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ids) == 0 {
+		return "", errors.Wrapf(ErrNotFound, "%v in index %s", values, name)
+	}
+
+	return ids[0], nil
+}
+
+// Scan calls fn with the key and ID of the records with keys from from
+// inclusive to to exclusive, in the order of the keys. The bounds can
+// contain the values of fewer fields than the index, a nil bound is
+// unbounded.
+func Scan(tx bolted.ReadTx, name string, from, to []interface{}, fn func(key []interface{}, id string) error) error {
+	var fromKey, toKey string
+	var err error
+
+	if from != nil {
+		fromKey, err = encodeKey(from)
+		if err != nil {
+			return err
+		}
+	}
+
+	if to != nil {
+		toKey, err = encodeKey(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scan(tx, name, fromKey, func(key string) bool {
+		return to == nil || key < toKey
+	}, fn)
+}
+
+// ScanPrefix calls fn with the key and ID of the records with keys starting
+// with the values, in the order of the keys.
+func ScanPrefix(tx bolted.ReadTx, name string, prefix []interface{}, fn func(key []interface{}, id string) error) error {
+	prefixKey, err := encodeKey(prefix)
+	if err != nil {
+		return err
+	}
+
+	return scan(tx, name, prefixKey, func(key string) bool {
+		return strings.HasPrefix(key, prefixKey)
+	}, fn)
+}
+
+func scan(tx bolted.ReadTx, name, from string, within func(key string) bool, fn func(key []interface{}, id string) error) error {
+	_, err := readDefinition(tx, name)
+	if err != nil {
+		return err
+	}
+
+	entriesPath := dbpath.Join(indexesMapName, name, entriesMapName)
+
+	it, err := tx.Iterator(entriesPath)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	for it.Seek(from); !it.Done && within(it.Key); it.Next() {
+		keys = append(keys, it.Key)
+	}
+
+	for _, key := range keys {
+		values, err := decodeKey(key)
+		if err != nil {
+			return errors.Wrapf(err, "while decoding key of index %s", name)
+		}
+
+		ids, err := tx.Iterator(dbpath.Append(entriesPath, key))
+		if err != nil {
+			return err
+		}
+
+		for ; !ids.Done; ids.Next() {
+			err = fn(values, ids.Key)
+			if err == ErrStop {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Package paths looks up database paths for the packages of boltimore.
+// bolted fails to look up paths when one of their parents does not exist,
+// the functions of this package report such paths as missing.
+package paths
+
+import (
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+)
+
+// Normalize removes leading, trailing and duplicate separators.
+func Normalize(pth string) (string, error) {
+	parts, err := dbpath.Split(pth)
+	if err != nil {
+		return "", err
+	}
+	return dbpath.Join(parts...), nil
+}
+
+// Lookup returns whether pth exists and whether it is a map.
+// The root is an existing map.
+func Lookup(tx bolted.ReadTx, pth string) (exists bool, isMap bool, err error) {
+	parts, err := dbpath.Split(pth)
+	if err != nil {
+		return false, false, err
+	}
+
+	for i := range parts {
+		p := dbpath.Join(parts[:i+1]...)
+		ex, err := tx.Exists(p)
+		if err != nil || !ex {
+			return false, false, err
+		}
+
+		m, err := tx.IsMap(p)
+		if err != nil {
+			return false, false, err
+		}
+
+		if !m {
+			// a value can't have children
+			return i == len(parts)-1, false, nil
+		}
+	}
+
+	return true, true, nil
+}
+
+// Exists returns whether pth exists.
+func Exists(tx bolted.ReadTx, pth string) (bool, error) {
+	ex, _, err := Lookup(tx, pth)
+	return ex, err
+}
+
+// IsMap returns whether pth is an existing map.
+func IsMap(tx bolted.ReadTx, pth string) (bool, error) {
+	ex, m, err := Lookup(tx, pth)
+	return ex && m, err
+}
@@ -0,0 +1,55 @@
+package paths_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	db, err := bolted.Open(filepath.Join(t.TempDir(), "db"), 0700)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+		return tx.Put("users/alice", []byte("alice"))
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		pth    string
+		exists bool
+		isMap  bool
+	}{
+		{"", true, true},
+		{"users", true, true},
+		{"users/alice", true, false},
+		{"users/bob", false, false},
+		{"users/alice/child", false, false},
+		{"groups/admins", false, false},
+	}
+
+	err = db.Read(func(tx bolted.ReadTx) error {
+		for _, c := range cases {
+			ex, m, err := paths.Lookup(tx, c.pth)
+			require.NoError(t, err, c.pth)
+			require.Equal(t, c.exists, ex, c.pth)
+			require.Equal(t, c.isMap, m, c.pth)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestNormalize(t *testing.T) {
+	pth, err := paths.Normalize("/users//alice/")
+	require.NoError(t, err)
+	require.Equal(t, "users/alice", pth)
+}
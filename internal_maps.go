@@ -0,0 +1,43 @@
+package boltimore
+
+import (
+	"sync"
+
+	"github.com/draganm/bolted/dbpath"
+)
+
+// internalMaps are the top level maps maintained by boltimore and its
+// packages, mapped to whether they are backed up.
+var (
+	internalMapsMu = new(sync.Mutex)
+	internalMaps   = map[string]bool{
+		jobsMapName:       true,
+		migrationsMapName: true,
+	}
+)
+
+// RegisterInternalMap registers the top level map name as maintained by
+// boltimore or one of its packages instead of by the application. Internal
+// maps are neither exported nor imported as JSON. Maps that are not backed
+// up, like the change log or maps rebuilt from the rest of the database, are
+// neither part of backups nor written by restores.
+// Packages register their maps when they are initialized.
+func RegisterInternalMap(name string, backedUp bool) {
+	internalMapsMu.Lock()
+	defer internalMapsMu.Unlock()
+	internalMaps[name] = backedUp
+}
+
+// InternalMap returns whether pth is within an internal map and whether the
+// map is backed up.
+func InternalMap(pth string) (internal bool, backedUp bool) {
+	parts, err := dbpath.Split(pth)
+	if err != nil || len(parts) == 0 {
+		return false, false
+	}
+
+	internalMapsMu.Lock()
+	defer internalMapsMu.Unlock()
+	backedUp, internal = internalMaps[parts[0]]
+	return internal, backedUp
+}
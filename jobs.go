@@ -0,0 +1,630 @@
+package boltimore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const jobsMapName = "__jobs"
+
+const (
+	JobStatePending = "pending"
+	JobStateRunning = "running"
+	JobStateDead    = "dead"
+)
+
+var jobStates = []string{JobStatePending, JobStateRunning, JobStateDead}
+
+type Job struct {
+	ID          string    `json:"id"`
+	Queue       string    `json:"queue"`
+	Payload     []byte    `json:"payload"`
+	Attempts    int       `json:"attempts"`
+	RunAt       time.Time `json:"runAt"`
+	LeasedUntil time.Time `json:"leasedUntil,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// Enqueue adds a job to the queue as part of the write transaction.
+// The job will not be picked up by a worker before runAt and not before the
+// transaction is committed.
+func Enqueue(tx bolted.WriteTx, queue string, payload []byte, runAt time.Time) (string, error) {
+	err := ensureJobMaps(tx, queue)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return "", errors.Wrap(err, "while generating job id")
+	}
+
+	j := Job{
+		ID:      id,
+		Queue:   queue,
+		Payload: payload,
+		RunAt:   runAt,
+	}
+
+	err = putJob(tx, pendingJobPath(j), j)
+	if err != nil {
+		return "", errors.Wrapf(err, "while enqueuing job on %s", queue)
+	}
+
+	return id, nil
+}
+
+type JobWorkerConfig struct {
+	// Concurrency is the number of jobs processed in parallel, defaults to 1.
+	Concurrency int
+	// MaxAttempts is the number of times a job is tried before it is moved
+	// to the dead letter storage, defaults to 5.
+	MaxAttempts int
+	// VisibilityTimeout is the time after which a job that has not been
+	// completed by a worker is handed out again, defaults to 5 minutes.
+	VisibilityTimeout time.Duration
+	// PollInterval is the maximum time between two checks of the queue,
+	// defaults to 10 seconds.
+	PollInterval time.Duration
+	// Backoff returns the delay before retrying a job that failed on the
+	// given attempt, defaults to exponential backoff starting at 1 second
+	// and capped at 1 hour.
+	Backoff func(attempt int) time.Duration
+}
+
+func (c JobWorkerConfig) withDefaults() JobWorkerConfig {
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.VisibilityTimeout <= 0 {
+		c.VisibilityTimeout = 5 * time.Minute
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = 10 * time.Second
+	}
+	if c.Backoff == nil {
+		c.Backoff = ExponentialBackoff(time.Second, time.Hour)
+	}
+	return c
+}
+
+func ExponentialBackoff(initial, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 1; i < attempt; i++ {
+			d *= 2
+			if d >= max {
+				return max
+			}
+		}
+		return d
+	}
+}
+
+type JobContext struct {
+	Context context.Context
+	DB      *DB
+	Logger  *zap.SugaredLogger
+	Job     Job
+}
+
+func JobWorkers(queue string, config JobWorkerConfig, fn func(jc *JobContext) error) Option {
+	return Option(func(b *Boltimore) error {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			return ensureJobMaps(tx, queue)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "while creating maps for job queue %s", queue)
+		}
+
+		q := &jobQueue{
+			b:      b,
+			name:   queue,
+			config: config.withDefaults(),
+			fn:     fn,
+			wake:   make(chan struct{}, 1),
+			logger: b.logger.With("jobQueue", queue),
+		}
+
+		b.goBackground(func(ctx context.Context) {
+			b.Watcher.WatchForChanges(ctx, dbpath.Join(jobsMapName, queue, JobStatePending), func(tx bolted.ReadTx) error {
+				q.wakeOne()
+				return nil
+			})
+		})
+
+		for i := 0; i < q.config.Concurrency; i++ {
+			b.goBackground(q.work)
+		}
+
+		return nil
+	})
+}
+
+type jobQueue struct {
+	b      *Boltimore
+	name   string
+	config JobWorkerConfig
+	fn     func(jc *JobContext) error
+	wake   chan struct{}
+	logger *zap.SugaredLogger
+}
+
+func (q *jobQueue) wakeOne() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, nextRunAt, err := q.lease()
+		if err != nil {
+			q.logger.With("error", err).Error("while leasing job")
+		}
+
+		if job != nil {
+			// there might be more jobs waiting, let another worker look
+			q.wakeOne()
+			q.process(ctx, *job)
+			continue
+		}
+
+		wait := q.config.PollInterval
+		if !nextRunAt.IsZero() {
+			untilNext := nextRunAt.Sub(q.b.clock.Now())
+			if untilNext < wait {
+				wait = untilNext
+			}
+		}
+
+		t := q.b.clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-t.C():
+		}
+		t.Stop()
+	}
+}
+
+// lease returns the next due job, marking it as running.
+// When no job is due, it returns the time the next pending job will be due.
+func (q *jobQueue) lease() (job *Job, nextRunAt time.Time, err error) {
+	now := q.b.clock.Now()
+	err = q.b.DB.Write(func(tx bolted.WriteTx) error {
+		err := q.requeueExpired(tx, now)
+		if err != nil {
+			return err
+		}
+
+		pendingPath := dbpath.Join(jobsMapName, q.name, JobStatePending)
+		it, err := tx.Iterator(pendingPath)
+		if err != nil {
+			return err
+		}
+
+		if it.Done {
+			return nil
+		}
+
+		key := it.Key
+		j := Job{}
+		err = json.Unmarshal(it.Value, &j)
+		if err != nil {
+			return errors.Wrapf(err, "while parsing job %s", key)
+		}
+
+		if j.RunAt.After(now) {
+			nextRunAt = j.RunAt
+			return nil
+		}
+
+		err = tx.Delete(dbpath.Append(pendingPath, key))
+		if err != nil {
+			return err
+		}
+
+		j.Attempts++
+		j.LeasedUntil = now.Add(q.config.VisibilityTimeout)
+
+		err = putJob(tx, jobPath(q.name, JobStateRunning, j.ID), j)
+		if err != nil {
+			return err
+		}
+
+		job = &j
+		return nil
+	})
+
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return job, nextRunAt, nil
+}
+
+func (q *jobQueue) requeueExpired(tx bolted.WriteTx, now time.Time) error {
+	runningPath := dbpath.Join(jobsMapName, q.name, JobStateRunning)
+	it, err := tx.Iterator(runningPath)
+	if err != nil {
+		return err
+	}
+
+	expired := []Job{}
+	for ; !it.Done; it.Next() {
+		j := Job{}
+		err = json.Unmarshal(it.Value, &j)
+		if err != nil {
+			return errors.Wrapf(err, "while parsing job %s", it.Key)
+		}
+		if !j.LeasedUntil.After(now) {
+			expired = append(expired, j)
+		}
+	}
+
+	for _, j := range expired {
+		q.logger.With("jobID", j.ID).Warn("visibility timeout expired")
+		err = q.fail(tx, j, "visibility timeout expired", now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *jobQueue) process(ctx context.Context, j Job) {
+	logger := q.logger.With("jobID", j.ID, "attempt", j.Attempts)
+
+	err := q.call(&JobContext{
+		Context: ctx,
+		DB:      q.b.DB,
+		Logger:  logger,
+		Job:     j,
+	})
+
+	if err != nil {
+		logger.With("error", err).Warn("job failed")
+	}
+
+	err = q.complete(j, err)
+	if err != nil {
+		logger.With("error", err).Error("while completing job")
+	}
+}
+
+func (q *jobQueue) call(jc *JobContext) (err error) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			err = errors.Errorf("panic: %v", p)
+		}
+	}()
+	return q.fn(jc)
+}
+
+func (q *jobQueue) complete(j Job, jobErr error) error {
+	return q.b.DB.Write(func(tx bolted.WriteTx) error {
+		current, err := getJob(tx, jobPath(q.name, JobStateRunning, j.ID))
+		if err != nil {
+			return err
+		}
+
+		if current == nil || current.Attempts != j.Attempts {
+			q.logger.With("jobID", j.ID).Warn("lease was lost before the job was completed")
+			return nil
+		}
+
+		if jobErr == nil {
+			return tx.Delete(jobPath(q.name, JobStateRunning, j.ID))
+		}
+
+		return q.fail(tx, *current, jobErr.Error(), q.b.clock.Now())
+	})
+}
+
+// fail removes a running job and either schedules it for retry or moves it
+// to the dead letter storage.
+func (q *jobQueue) fail(tx bolted.WriteTx, j Job, reason string, now time.Time) error {
+	err := tx.Delete(jobPath(q.name, JobStateRunning, j.ID))
+	if err != nil {
+		return err
+	}
+
+	j.LastError = reason
+	j.LeasedUntil = time.Time{}
+
+	if j.Attempts >= q.config.MaxAttempts {
+		q.logger.With("jobID", j.ID, "attempts", j.Attempts).Error("job moved to dead letter storage")
+		return putJob(tx, jobPath(q.name, JobStateDead, j.ID), j)
+	}
+
+	j.RunAt = now.Add(q.config.Backoff(j.Attempts))
+	return putJob(tx, pendingJobPath(j), j)
+}
+
+// JobAdminEndpoints adds endpoints to inspect job queues and requeue dead jobs:
+//
+//	GET    <prefix>                                 lists the queues
+//	GET    <prefix>/{queue}/{state}                 lists jobs in pending, running or dead state
+//	POST   <prefix>/{queue}/dead/{id}/requeue       moves a dead job back to pending
+//	DELETE <prefix>/{queue}/dead/{id}               removes a dead job
+func JobAdminEndpoints(prefix string) Option {
+	return Option(func(b *Boltimore) error {
+		b.addEndpoint("GET", prefix, listJobQueues)
+		b.addEndpoint("GET", prefix+"/{queue}/{state}", listJobs)
+		b.addEndpoint("POST", prefix+"/{queue}/dead/{id}/requeue", func(rc *RequestContext) error {
+			return requeueDeadJob(rc, b.clock.Now())
+		})
+		b.addEndpoint("DELETE", prefix+"/{queue}/dead/{id}", deleteDeadJob)
+		return nil
+	})
+}
+
+func listJobQueues(rc *RequestContext) error {
+	queues := []string{}
+	err := rc.DB.Read(func(tx bolted.ReadTx) error {
+		ex, err := tx.Exists(jobsMapName)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			return nil
+		}
+
+		it, err := tx.Iterator(jobsMapName)
+		if err != nil {
+			return err
+		}
+
+		for ; !it.Done; it.Next() {
+			queues = append(queues, it.Key)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithJSON(queues)
+}
+
+func listJobs(rc *RequestContext) error {
+	queue := rc.RouteVariable("queue")
+	state := rc.RouteVariable("state")
+
+	if !isJobState(state) {
+		return rc.RespondWithError(fmt.Sprintf("unknown job state %q", state), 404)
+	}
+
+	jobs := []Job{}
+	err := rc.DB.Read(func(tx bolted.ReadTx) error {
+		pth := dbpath.Join(jobsMapName, queue, state)
+		ex, err := jobMapExists(tx, queue)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			return nil
+		}
+
+		it, err := tx.Iterator(pth)
+		if err != nil {
+			return err
+		}
+
+		for ; !it.Done; it.Next() {
+			j := Job{}
+			err = json.Unmarshal(it.Value, &j)
+			if err != nil {
+				return errors.Wrapf(err, "while parsing job %s", it.Key)
+			}
+			jobs = append(jobs, j)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithJSON(jobs)
+}
+
+func requeueDeadJob(rc *RequestContext, now time.Time) error {
+	queue := rc.RouteVariable("queue")
+	id := rc.RouteVariable("id")
+
+	found := false
+	var requeued Job
+
+	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+		ex, err := jobMapExists(tx, queue)
+		if err != nil || !ex {
+			return err
+		}
+
+		pth := jobPath(queue, JobStateDead, id)
+		j, err := getJob(tx, pth)
+		if err != nil || j == nil {
+			return err
+		}
+
+		found = true
+
+		err = tx.Delete(pth)
+		if err != nil {
+			return err
+		}
+
+		j.Attempts = 0
+		j.RunAt = now
+		requeued = *j
+
+		return putJob(tx, pendingJobPath(requeued), requeued)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return rc.RespondWithError("job not found", 404)
+	}
+
+	return rc.RespondWithJSON(requeued)
+}
+
+func deleteDeadJob(rc *RequestContext) error {
+	queue := rc.RouteVariable("queue")
+	id := rc.RouteVariable("id")
+
+	found := false
+
+	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+		ex, err := jobMapExists(tx, queue)
+		if err != nil || !ex {
+			return err
+		}
+
+		pth := jobPath(queue, JobStateDead, id)
+		found, err = tx.Exists(pth)
+		if err != nil || !found {
+			return err
+		}
+
+		return tx.Delete(pth)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return rc.RespondWithError("job not found", 404)
+	}
+
+	return rc.RespondWithStatusCode(204)
+}
+
+func isJobState(state string) bool {
+	for _, s := range jobStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func jobMapExists(tx bolted.ReadTx, queue string) (bool, error) {
+	ex, err := tx.Exists(jobsMapName)
+	if err != nil || !ex {
+		return false, err
+	}
+	return tx.Exists(dbpath.Join(jobsMapName, queue))
+}
+
+func ensureJobMaps(tx bolted.WriteTx, queue string) error {
+	err := ensureMap(tx, jobsMapName)
+	if err != nil {
+		return err
+	}
+
+	err = ensureMap(tx, dbpath.Join(jobsMapName, queue))
+	if err != nil {
+		return err
+	}
+
+	for _, s := range jobStates {
+		err = ensureMap(tx, dbpath.Join(jobsMapName, queue, s))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ensureMap(tx bolted.WriteTx, pth string) error {
+	ex, err := tx.Exists(pth)
+	if err != nil {
+		return err
+	}
+
+	if ex {
+		return nil
+	}
+
+	return tx.CreateMap(pth)
+}
+
+func jobPath(queue, state, id string) string {
+	return dbpath.Join(jobsMapName, queue, state, id)
+}
+
+// pendingJobPath orders pending jobs by the time they are due.
+func pendingJobPath(j Job) string {
+	runAt := int64(0)
+	if j.RunAt.After(time.Unix(0, 0)) {
+		runAt = j.RunAt.UnixNano()
+	}
+	return jobPath(j.Queue, JobStatePending, fmt.Sprintf("%020d-%s", runAt, j.ID))
+}
+
+func putJob(tx bolted.WriteTx, pth string, j Job) error {
+	d, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return tx.Put(pth, d)
+}
+
+func getJob(tx bolted.ReadTx, pth string) (*Job, error) {
+	ex, err := tx.Exists(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ex {
+		return nil, nil
+	}
+
+	d, err := tx.Get(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Job{}
+	err = json.Unmarshal(d, j)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing job %s", pth)
+	}
+
+	return j, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,271 @@
+package boltimore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func listJobs(t *testing.T, b *boltimore.Boltimore, queue, state string) []boltimore.Job {
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/"+queue+"/"+state, nil))
+	require.Equal(t, 200, rec.Code)
+
+	jobs := []boltimore.Job{}
+	err := json.Unmarshal(rec.Body.Bytes(), &jobs)
+	require.NoError(t, err)
+	return jobs
+}
+
+func waitForJobs(t *testing.T, b *boltimore.Boltimore, queue, state string, cnt int) []boltimore.Job {
+	var jobs []boltimore.Job
+	for i := 0; i < 200; i++ {
+		jobs = listJobs(t, b, queue, state)
+		if len(jobs) == cnt {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, jobs, cnt)
+	return jobs
+}
+
+func TestJobs(t *testing.T) {
+
+	t.Run("processing enqueued job", func(t *testing.T) {
+		payloads := make(chan string, 1)
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.JobAdminEndpoints("/jobs"),
+			boltimore.JobWorkers("mail", boltimore.JobWorkerConfig{}, func(jc *boltimore.JobContext) error {
+				payloads <- string(jc.Job.Payload)
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err := boltimore.Enqueue(tx, "mail", []byte("hello"), fc.Now())
+			return err
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", <-payloads)
+		waitForJobs(t, b, "mail", "running", 0)
+	})
+
+	t.Run("change listeners are notified of removed jobs", func(t *testing.T) {
+		r := &deleteRecorder{}
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.ChangeListener(r),
+			boltimore.JobAdminEndpoints("/jobs"),
+			boltimore.JobWorkers("mail", boltimore.JobWorkerConfig{}, func(jc *boltimore.JobContext) error {
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err := boltimore.Enqueue(tx, "mail", []byte("hello"), fc.Now())
+			return err
+		})
+		require.NoError(t, err)
+
+		// the job is removed from pending when it's started and from
+		// running when it's done
+		for i := 0; i < 200 && len(r.paths()) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		removed := map[string]int{}
+		for _, pth := range r.paths() {
+			parts, err := dbpath.Split(pth)
+			require.NoError(t, err)
+			require.Len(t, parts, 4)
+			removed[parts[2]]++
+		}
+
+		require.Equal(t, map[string]int{"pending": 1, "running": 1}, removed)
+	})
+
+	t.Run("job scheduled in the future", func(t *testing.T) {
+		executed := make(chan bool, 1)
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.JobWorkers("mail", boltimore.JobWorkerConfig{}, func(jc *boltimore.JobContext) error {
+				executed <- true
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err := boltimore.Enqueue(tx, "mail", nil, fc.Now().Add(time.Hour))
+			return err
+		})
+		require.NoError(t, err)
+
+		fc.BlockUntil(1)
+		fc.Advance(59 * time.Minute)
+		fc.BlockUntil(1)
+
+		select {
+		case <-executed:
+			require.Fail(t, "job executed before it was due")
+		default:
+		}
+
+		fc.Advance(time.Minute)
+		<-executed
+	})
+
+	t.Run("retries, dead letter and requeue", func(t *testing.T) {
+		attempts := make(chan int, 10)
+		calls := 0
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.JobAdminEndpoints("/jobs"),
+			boltimore.JobWorkers(
+				"mail",
+				boltimore.JobWorkerConfig{
+					MaxAttempts: 2,
+					Backoff: func(attempt int) time.Duration {
+						return time.Minute
+					},
+				},
+				func(jc *boltimore.JobContext) error {
+					calls++
+					attempts <- jc.Job.Attempts
+					if calls == 2 {
+						panic("boom")
+					}
+					if calls < 3 {
+						return errors.New("failed")
+					}
+					return nil
+				},
+			),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		var id string
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			id, err = boltimore.Enqueue(tx, "mail", nil, fc.Now())
+			return err
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+
+		pending := waitForJobs(t, b, "mail", "pending", 1)
+		require.Equal(t, "failed", pending[0].LastError)
+		require.Equal(t, fc.Now().Add(time.Minute), pending[0].RunAt)
+
+		fc.BlockUntil(1)
+		fc.Advance(time.Minute)
+
+		require.Equal(t, 2, <-attempts)
+
+		dead := waitForJobs(t, b, "mail", "dead", 1)
+		require.Equal(t, id, dead[0].ID)
+		require.Equal(t, "panic: boom", dead[0].LastError)
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/jobs/mail/dead/"+id+"/requeue", nil))
+		require.Equal(t, 200, rec.Code)
+
+		require.Equal(t, 1, <-attempts)
+
+		waitForJobs(t, b, "mail", "dead", 0)
+		waitForJobs(t, b, "mail", "running", 0)
+		waitForJobs(t, b, "mail", "pending", 0)
+
+		rec = httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("POST", "/jobs/mail/dead/"+id+"/requeue", nil))
+		require.Equal(t, 404, rec.Code)
+	})
+
+	t.Run("visibility timeout", func(t *testing.T) {
+		attempts := make(chan int, 10)
+		release := make(chan bool)
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.JobAdminEndpoints("/jobs"),
+			boltimore.JobWorkers(
+				"mail",
+				boltimore.JobWorkerConfig{
+					Concurrency:       2,
+					VisibilityTimeout: time.Minute,
+					Backoff: func(attempt int) time.Duration {
+						return 0
+					},
+				},
+				func(jc *boltimore.JobContext) error {
+					attempts <- jc.Job.Attempts
+					if jc.Job.Attempts == 1 {
+						<-release
+					}
+					return nil
+				},
+			),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		err = b.DB.Write(func(tx bolted.WriteTx) error {
+			_, err = boltimore.Enqueue(tx, "mail", nil, fc.Now())
+			return err
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+
+		fc.BlockUntil(1)
+		fc.Advance(time.Minute)
+
+		require.Equal(t, 2, <-attempts)
+		close(release)
+
+		waitForJobs(t, b, "mail", "running", 0)
+		waitForJobs(t, b, "mail", "pending", 0)
+	})
+
+	t.Run("unknown job state", func(t *testing.T) {
+		b, err := boltimore.Open(t.TempDir(), boltimore.JobAdminEndpoints("/jobs"))
+		require.NoError(t, err)
+		defer b.Close()
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/mail/foo", nil))
+		require.Equal(t, 404, rec.Code)
+	})
+
+}
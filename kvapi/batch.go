@@ -0,0 +1,269 @@
+package kvapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+// Operations of a batch. Equals, Exists and NotExists are preconditions,
+// the batch fails when they don't hold.
+const (
+	OpPut       = "put"
+	OpDelete    = "delete"
+	OpCreateMap = "createMap"
+	OpGet       = "get"
+	OpEquals    = "equals"
+	OpExists    = "exists"
+	OpNotExists = "notExists"
+)
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// Value is a value in a batch, encoded as a JSON string when it is valid
+// UTF-8 and as {"$base64": "..."} otherwise, like in fixtures.
+type Value []byte
+
+const base64Key = "$base64"
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(v) {
+		return json.Marshal(string(v))
+	}
+	return json.Marshal(map[string]string{base64Key: base64.StdEncoding.EncodeToString(v)})
+}
+
+func (v *Value) UnmarshalJSON(d []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(d), []byte("{")) {
+		m := map[string]string{}
+		err := json.Unmarshal(d, &m)
+		if err != nil {
+			return err
+		}
+
+		encoded, found := m[base64Key]
+		if !found || len(m) != 1 {
+			return errors.Errorf("a value object must have the single key %s", base64Key)
+		}
+
+		*v, err = base64.StdEncoding.DecodeString(encoded)
+		return err
+	}
+
+	var s string
+	err := json.Unmarshal(d, &s)
+	if err != nil {
+		return err
+	}
+
+	*v = Value(s)
+	return nil
+}
+
+// Operation is an operation of a batch. Path is escaped like the paths of
+// the key/value endpoints.
+type Operation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value *Value `json:"value,omitempty"`
+}
+
+// Batch is the request of the batch endpoint.
+type Batch struct {
+	Operations []Operation `json:"operations"`
+}
+
+// Result is the result of an operation. Value is set by get, unless the
+// value does not exist.
+type Result struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value *Value `json:"value,omitempty"`
+}
+
+// BatchFailure is the operation that failed the batch.
+type BatchFailure struct {
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// BatchResponse holds the results of all operations when the batch has been
+// applied, or the failed operation when it has been rolled back.
+type BatchResponse struct {
+	Results []Result      `json:"results,omitempty"`
+	Failed  *BatchFailure `json:"failed,omitempty"`
+}
+
+// BatchEndpoint adds a POST endpoint at path applying the operations of a
+// Batch in a single write transaction. Every operation is authorized before
+// the transaction starts. When an operation fails, for example a
+// precondition doesn't hold or a deleted path doesn't exist, nothing is
+// written and the endpoint responds with 409 and the failed operation.
+func BatchEndpoint(path string, opts ...Option) boltimore.Option {
+	return func(b *boltimore.Boltimore) error {
+		c, err := newConfig(opts)
+		if err != nil {
+			return err
+		}
+
+		return boltimore.Endpoint("POST", path, c.batch)(b)
+	}
+}
+
+func (c *config) batch(rc *boltimore.RequestContext) error {
+	batch := Batch{}
+	err := rc.ParseJSON(&batch)
+	if err != nil {
+		return rc.RespondWithError(errors.Wrap(err, "while parsing batch").Error(), 400)
+	}
+
+	for i, o := range batch.Operations {
+		pth, err := paths.Normalize(o.Path)
+		if err != nil {
+			return rc.RespondWithError(errors.Wrapf(err, "operation %d", i).Error(), 400)
+		}
+
+		err = validateOperation(o, pth)
+		if err != nil {
+			return rc.RespondWithError(errors.Wrapf(err, "operation %d", i).Error(), 400)
+		}
+
+		batch.Operations[i].Path = pth
+	}
+
+	for _, o := range batch.Operations {
+		access := Read
+		if o.Op == OpPut || o.Op == OpDelete || o.Op == OpCreateMap {
+			access = Write
+		}
+
+		if !c.allowed(rc, access, o.Path) {
+			return nil
+		}
+	}
+
+	var results []Result
+	var failure *BatchFailure
+
+	err = rc.DB.Write(func(tx bolted.WriteTx) error {
+		results = make([]Result, len(batch.Operations))
+		for i, o := range batch.Operations {
+			r, err := apply(tx, o)
+			switch errors.Cause(err) {
+			case errNotFound, errConflict, errPreconditionFailed:
+				failure = &BatchFailure{
+					Index: i,
+					Op:    o.Op,
+					Path:  o.Path,
+					Error: err.Error(),
+				}
+			}
+
+			if err != nil {
+				return err
+			}
+
+			results[i] = r
+		}
+		return nil
+	})
+
+	if failure != nil {
+		return rc.RespondWithStatusCodeAndJSON(409, BatchResponse{Failed: failure})
+	}
+
+	if err != nil {
+		rc.Logger.With("error", err).Error("batch failed")
+		return err
+	}
+
+	return rc.RespondWithJSON(BatchResponse{Results: results})
+}
+
+func validateOperation(o Operation, pth string) error {
+	switch o.Op {
+	case OpPut, OpEquals:
+		if o.Value == nil {
+			return errors.Errorf("%s requires a value", o.Op)
+		}
+	case OpDelete, OpCreateMap, OpGet, OpExists, OpNotExists:
+	default:
+		return errors.Errorf("unknown operation %q", o.Op)
+	}
+
+	if pth == "" && o.Op != OpExists && o.Op != OpNotExists {
+		return errors.Errorf("%s requires a path", o.Op)
+	}
+
+	return nil
+}
+
+func apply(tx bolted.WriteTx, o Operation) (Result, error) {
+	r := Result{Op: o.Op, Path: o.Path}
+
+	switch o.Op {
+	case OpPut:
+		return r, putValue(tx, o.Path, *o.Value)
+	case OpDelete:
+		return r, deletePath(tx, o.Path)
+	case OpCreateMap:
+		return r, createMap(tx, o.Path)
+	}
+
+	ex, err := paths.Exists(tx, o.Path)
+	if err != nil {
+		return r, err
+	}
+
+	switch o.Op {
+	case OpExists:
+		if !ex {
+			return r, errors.Wrapf(errPreconditionFailed, "%s does not exist", o.Path)
+		}
+		return r, nil
+	case OpNotExists:
+		if ex {
+			return r, errors.Wrapf(errPreconditionFailed, "%s exists", o.Path)
+		}
+		return r, nil
+	}
+
+	var v []byte
+	if ex {
+		isMap, err := tx.IsMap(o.Path)
+		if err != nil {
+			return r, err
+		}
+
+		if isMap {
+			return r, errors.Wrapf(errConflict, "%s is a map", o.Path)
+		}
+
+		v, err = tx.Get(o.Path)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if o.Op == OpEquals {
+		if !ex || !bytes.Equal(v, *o.Value) {
+			return r, errors.Wrapf(errPreconditionFailed, "%s does not equal the value", o.Path)
+		}
+		return r, nil
+	}
+
+	if ex {
+		value := Value(append([]byte(nil), v...))
+		r.Value = &value
+	}
+
+	return r, nil
+}
@@ -0,0 +1,134 @@
+package kvapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/kvapi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func value(s string) *kvapi.Value {
+	v := kvapi.Value(s)
+	return &v
+}
+
+func TestBatch(t *testing.T) {
+	authorize := func(r *http.Request, access kvapi.Access, pth string) error {
+		if pth == "secret" {
+			return errors.New("forbidden")
+		}
+		return nil
+	}
+
+	b, err := boltimore.Open(t.TempDir(), kvapi.BatchEndpoint("/batch", kvapi.Authorize(authorize)))
+	require.NoError(t, err)
+	defer b.Close()
+
+	s := httptest.NewServer(b)
+	defer s.Close()
+
+	post := func(batch interface{}) (int, kvapi.BatchResponse) {
+		d, err := json.Marshal(batch)
+		require.NoError(t, err)
+		res, err := http.Post(s.URL+"/batch", "application/json", bytes.NewReader(d))
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		br := kvapi.BatchResponse{}
+		if res.Header.Get("Content-Type") == "application/json" {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&br))
+		}
+		return res.StatusCode, br
+	}
+
+	get := func(pth string) []byte {
+		var v []byte
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			ex, err := tx.Exists(pth)
+			if err != nil || !ex {
+				return err
+			}
+			v, err = tx.Get(pth)
+			return err
+		})
+		require.NoError(t, err)
+		return v
+	}
+
+	t.Run("applies all operations", func(t *testing.T) {
+		code, res := post(kvapi.Batch{Operations: []kvapi.Operation{
+			{Op: kvapi.OpNotExists, Path: "users/alice"},
+			{Op: kvapi.OpCreateMap, Path: "users"},
+			{Op: kvapi.OpPut, Path: "users/alice", Value: value("alice")},
+			{Op: kvapi.OpPut, Path: "users/binary", Value: value("\xff\x00")},
+			{Op: kvapi.OpEquals, Path: "users/alice", Value: value("alice")},
+			{Op: kvapi.OpGet, Path: "users/binary"},
+			{Op: kvapi.OpGet, Path: "users/bob"},
+		}})
+		require.Equal(t, 200, code)
+		require.Nil(t, res.Failed)
+		require.Len(t, res.Results, 7)
+		require.Equal(t, value("\xff\x00"), res.Results[5].Value)
+		require.Nil(t, res.Results[6].Value)
+
+		require.Equal(t, []byte("alice"), get("users/alice"))
+	})
+
+	t.Run("failed precondition rolls back", func(t *testing.T) {
+		code, res := post(kvapi.Batch{Operations: []kvapi.Operation{
+			{Op: kvapi.OpPut, Path: "users/carol", Value: value("carol")},
+			{Op: kvapi.OpDelete, Path: "users/alice"},
+			{Op: kvapi.OpEquals, Path: "users/binary", Value: value("other")},
+		}})
+		require.Equal(t, 409, code)
+		require.NotNil(t, res.Failed)
+		require.Equal(t, 2, res.Failed.Index)
+		require.Equal(t, kvapi.OpEquals, res.Failed.Op)
+
+		require.Nil(t, get("users/carol"))
+		require.Equal(t, []byte("alice"), get("users/alice"))
+	})
+
+	t.Run("failed operation rolls back", func(t *testing.T) {
+		code, res := post(kvapi.Batch{Operations: []kvapi.Operation{
+			{Op: kvapi.OpPut, Path: "users/carol", Value: value("carol")},
+			{Op: kvapi.OpCreateMap, Path: "users"},
+		}})
+		require.Equal(t, 409, code)
+		require.Equal(t, 1, res.Failed.Index)
+		require.Nil(t, get("users/carol"))
+	})
+
+	t.Run("invalid batch", func(t *testing.T) {
+		code, _ := post(kvapi.Batch{Operations: []kvapi.Operation{
+			{Op: "rename", Path: "users/alice"},
+		}})
+		require.Equal(t, 400, code)
+
+		code, _ = post(kvapi.Batch{Operations: []kvapi.Operation{
+			{Op: kvapi.OpPut, Path: "users/alice"},
+		}})
+		require.Equal(t, 400, code)
+
+		code, _ = post(map[string]interface{}{"operations": []interface{}{
+			map[string]interface{}{"op": "put", "path": "x", "value": map[string]string{"$hex": "00"}},
+		}})
+		require.Equal(t, 400, code)
+	})
+
+	t.Run("unauthorized operation", func(t *testing.T) {
+		code, _ := post(kvapi.Batch{Operations: []kvapi.Operation{
+			{Op: kvapi.OpPut, Path: "users/dave", Value: value("dave")},
+			{Op: kvapi.OpGet, Path: "secret"},
+		}})
+		require.Equal(t, 403, code)
+		require.Nil(t, get("users/dave"))
+	})
+}
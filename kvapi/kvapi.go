@@ -0,0 +1,420 @@
+// Package kvapi exposes the database over HTTP for admin tooling:
+//
+//	GET    <prefix>/<path>   value at path, or the entries of the map at path
+//	PUT    <prefix>/<path>   writes the request body as the value at path
+//	POST   <prefix>/<path>   creates a map at path
+//	DELETE <prefix>/<path>   deletes the value or map at path
+//
+// BatchEndpoint applies several operations in a single transaction.
+// Path parts are escaped like dbpath escapes them. Every request is checked
+// by the authorization hook before it touches the database.
+package kvapi
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+// Access is the kind of access a request needs.
+type Access string
+
+const (
+	Read  Access = "read"
+	Write Access = "write"
+)
+
+// ErrUnauthenticated returned by the authorization hook responds with 401,
+// any other error with 403.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+const defaultPageSize = 100
+
+var (
+	errNotFound = errors.New("not found")
+	errConflict = errors.New("conflict")
+)
+
+// Option configures the endpoints.
+type Option func(c *config)
+
+type config struct {
+	authorize func(r *http.Request, access Access, pth string) error
+	pageSize  int
+}
+
+// Authorize sets the hook deciding whether the request may access pth,
+// a nil error allows it. The endpoints fail without it.
+func Authorize(fn func(r *http.Request, access Access, pth string) error) Option {
+	return func(c *config) {
+		c.authorize = fn
+	}
+}
+
+// PageSize sets the default and maximal number of entries of a map listing,
+// 100 by default.
+func PageSize(n int) Option {
+	return func(c *config) {
+		c.pageSize = n
+	}
+}
+
+// Entry is an entry of a map listing. Key is not escaped, Size is the length
+// of a value, 0 for maps.
+type Entry struct {
+	Key  string `json:"key"`
+	Map  bool   `json:"map"`
+	Size int    `json:"size"`
+}
+
+// Listing is a page of the entries of a map. Next is set when there are
+// more entries, passing it as the after query parameter returns the next
+// page.
+type Listing struct {
+	Path    string  `json:"path"`
+	Entries []Entry `json:"entries"`
+	Next    string  `json:"next,omitempty"`
+}
+
+func newConfig(opts []Option) (*config, error) {
+	c := &config{pageSize: defaultPageSize}
+	for _, o := range opts {
+		o(c)
+	}
+
+	if c.authorize == nil {
+		return nil, errors.New("kvapi endpoints require an authorization hook")
+	}
+
+	if c.pageSize <= 0 {
+		return nil, errors.Errorf("invalid page size %d", c.pageSize)
+	}
+
+	return c, nil
+}
+
+// allowed calls the authorization hook and responds when it denies access.
+func (c *config) allowed(rc *boltimore.RequestContext, access Access, pth string) bool {
+	err := c.authorize(rc.Request, access, pth)
+	if err == nil {
+		return true
+	}
+
+	if errors.Cause(err) == ErrUnauthenticated {
+		rc.RespondWithError(err.Error(), 401)
+		return false
+	}
+
+	rc.RespondWithError(err.Error(), 403)
+	return false
+}
+
+// Endpoints adds the endpoints under prefix, e.g. "/kv".
+func Endpoints(prefix string, opts ...Option) boltimore.Option {
+	return func(b *boltimore.Boltimore) error {
+		c, err := newConfig(opts)
+		if err != nil {
+			return err
+		}
+
+		prefix = strings.TrimSuffix(prefix, "/")
+
+		for _, e := range []struct {
+			method string
+			access Access
+			fn     func(rc *boltimore.RequestContext, pth string) error
+		}{
+			{"GET", Read, c.get},
+			{"PUT", Write, c.put},
+			{"POST", Write, c.createMap},
+			{"DELETE", Write, c.delete},
+		} {
+			e := e
+			handler := func(rc *boltimore.RequestContext) error {
+				pth, err := requestPath(rc.Request, prefix)
+				if err != nil {
+					return rc.RespondWithError(err.Error(), 400)
+				}
+
+				if !c.allowed(rc, e.access, pth) {
+					return nil
+				}
+
+				err = e.fn(rc, pth)
+				switch errors.Cause(err) {
+				case errNotFound:
+					return rc.RespondWithError(err.Error(), 404)
+				case errConflict:
+					return rc.RespondWithError(err.Error(), 409)
+				}
+
+				if err != nil {
+					rc.Logger.With("error", err, "path", pth).Error("kv request failed")
+				}
+
+				return err
+			}
+
+			err := boltimore.Endpoint(e.method, prefix, handler)(b)
+			if err != nil {
+				return err
+			}
+
+			err = boltimore.Endpoint(e.method, prefix+"/{path:.*}", handler)(b)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func (c *config) get(rc *boltimore.RequestContext, pth string) error {
+	q := rc.Request.URL.Query()
+
+	limit := c.pageSize
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return rc.RespondWithError("invalid limit", 400)
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	var value []byte
+	var listing *Listing
+
+	err := rc.DB.Read(func(tx bolted.ReadTx) error {
+		ex, isMap, err := paths.Lookup(tx, pth)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			return errors.Wrap(errNotFound, pth)
+		}
+
+		if !isMap {
+			v, err := tx.Get(pth)
+			if err != nil {
+				return err
+			}
+			value = append([]byte(nil), v...)
+			return nil
+		}
+
+		l, err := list(tx, pth, q.Get("after"), limit)
+		if err != nil {
+			return err
+		}
+		listing = l
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if listing != nil {
+		return rc.RespondWithJSON(listing)
+	}
+
+	rc.ResponseWriter.Header().Set("Content-Type", "application/octet-stream")
+	rc.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	_, err = rc.ResponseWriter.Write(value)
+	return err
+}
+
+func list(tx bolted.ReadTx, pth, after string, limit int) (*Listing, error) {
+	it, err := tx.Iterator(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	if after != "" {
+		it.Seek(after)
+		if !it.Done && it.Key == after {
+			it.Next()
+		}
+	}
+
+	l := &Listing{
+		Path:    pth,
+		Entries: []Entry{},
+	}
+
+	for ; !it.Done; it.Next() {
+		if len(l.Entries) == limit {
+			l.Next = l.Entries[limit-1].Key
+			break
+		}
+
+		// values of nested maps are nil
+		l.Entries = append(l.Entries, Entry{
+			Key:  it.Key,
+			Map:  it.Value == nil,
+			Size: len(it.Value),
+		})
+	}
+
+	return l, nil
+}
+
+func (c *config) put(rc *boltimore.RequestContext, pth string) error {
+	if pth == "" {
+		return rc.RespondWithError("the root is a map", 400)
+	}
+
+	value, err := io.ReadAll(rc.Request.Body)
+	if err != nil {
+		return rc.RespondWithError(err.Error(), 400)
+	}
+
+	err = rc.DB.Write(func(tx bolted.WriteTx) error {
+		return putValue(tx, pth, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithStatusCode(204)
+}
+
+func (c *config) createMap(rc *boltimore.RequestContext, pth string) error {
+	if pth == "" {
+		return rc.RespondWithError("the root exists", 409)
+	}
+
+	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+		return createMap(tx, pth)
+	})
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithStatusCode(201)
+}
+
+func (c *config) delete(rc *boltimore.RequestContext, pth string) error {
+	if pth == "" {
+		return rc.RespondWithError("the root can't be deleted", 400)
+	}
+
+	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+		return deletePath(tx, pth)
+	})
+	if err != nil {
+		return err
+	}
+
+	return rc.RespondWithStatusCode(204)
+}
+
+// putValue writes the value at pth, creating the missing parent maps.
+func putValue(tx bolted.WriteTx, pth string, value []byte) error {
+	err := ensureParents(tx, pth)
+	if err != nil {
+		return err
+	}
+
+	ex, err := tx.Exists(pth)
+	if err != nil {
+		return err
+	}
+
+	if ex {
+		isMap, err := tx.IsMap(pth)
+		if err != nil {
+			return err
+		}
+
+		if isMap {
+			return errors.Wrapf(errConflict, "%s is a map", pth)
+		}
+	}
+
+	return tx.Put(pth, value)
+}
+
+// createMap creates the map at pth and its missing parent maps.
+func createMap(tx bolted.WriteTx, pth string) error {
+	err := ensureParents(tx, pth)
+	if err != nil {
+		return err
+	}
+
+	ex, err := tx.Exists(pth)
+	if err != nil {
+		return err
+	}
+
+	if ex {
+		return errors.Wrapf(errConflict, "%s exists", pth)
+	}
+
+	return tx.CreateMap(pth)
+}
+
+func deletePath(tx bolted.WriteTx, pth string) error {
+	ex, err := paths.Exists(tx, pth)
+	if err != nil {
+		return err
+	}
+
+	if !ex {
+		return errors.Wrap(errNotFound, pth)
+	}
+
+	return tx.Delete(pth)
+}
+
+// requestPath returns the database path of the request, taken from the
+// escaped URL path so that escaped separators stay within their part.
+func requestPath(r *http.Request, prefix string) (string, error) {
+	return paths.Normalize(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+}
+
+// ensureParents creates the missing parent maps of pth.
+func ensureParents(tx bolted.WriteTx, pth string) error {
+	parts, err := dbpath.Split(pth)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i < len(parts); i++ {
+		p := dbpath.Join(parts[:i]...)
+
+		ex, err := tx.Exists(p)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			err = tx.CreateMap(p)
+			if err != nil {
+				return errors.Wrapf(err, "while creating map %s", p)
+			}
+			continue
+		}
+
+		isMap, err := tx.IsMap(p)
+		if err != nil {
+			return err
+		}
+
+		if !isMap {
+			return errors.Wrapf(errConflict, "%s is not a map", p)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package kvapi_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/kvapi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVAPI(t *testing.T) {
+	authorize := func(r *http.Request, access kvapi.Access, pth string) error {
+		switch r.Header.Get("Authorization") {
+		case "admin":
+			return nil
+		case "reader":
+			if access == kvapi.Read {
+				return nil
+			}
+			return errors.New("read only")
+		}
+		return kvapi.ErrUnauthenticated
+	}
+
+	b, err := boltimore.Open(t.TempDir(), kvapi.Endpoints("/kv", kvapi.Authorize(authorize), kvapi.PageSize(2)))
+	require.NoError(t, err)
+	defer b.Close()
+
+	s := httptest.NewServer(b)
+	defer s.Close()
+
+	do := func(method, path, role, body string) (int, string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if role != "" {
+			req.Header.Set("Authorization", role)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		d, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(d)
+	}
+
+	list := func(path string) kvapi.Listing {
+		code, body := do("GET", path, "reader", "")
+		require.Equal(t, 200, code, body)
+		l := kvapi.Listing{}
+		require.NoError(t, json.Unmarshal([]byte(body), &l))
+		return l
+	}
+
+	t.Run("authorization", func(t *testing.T) {
+		code, _ := do("GET", "/kv/", "", "")
+		require.Equal(t, 401, code)
+
+		code, _ = do("PUT", "/kv/users/alice", "reader", "alice")
+		require.Equal(t, 403, code)
+	})
+
+	t.Run("write and read values", func(t *testing.T) {
+		code, body := do("PUT", "/kv/users/alice", "admin", "alice")
+		require.Equal(t, 204, code, body)
+
+		code, body = do("PUT", "/kv/users/a%2Fb", "admin", "slash")
+		require.Equal(t, 204, code, body)
+
+		code, body = do("GET", "/kv/users/alice", "reader", "")
+		require.Equal(t, 200, code)
+		require.Equal(t, "alice", body)
+
+		code, _ = do("GET", "/kv/users/bob", "reader", "")
+		require.Equal(t, 404, code)
+
+		code, _ = do("PUT", "/kv/users/alice/x", "admin", "x")
+		require.Equal(t, 409, code)
+
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			v, err := tx.Get("users/a%2Fb")
+			require.NoError(t, err)
+			require.Equal(t, []byte("slash"), v)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("create maps", func(t *testing.T) {
+		code, _ := do("POST", "/kv/users/groups", "admin", "")
+		require.Equal(t, 201, code)
+
+		code, _ = do("POST", "/kv/users/groups", "admin", "")
+		require.Equal(t, 409, code)
+
+		code, _ = do("PUT", "/kv/users/groups", "admin", "value")
+		require.Equal(t, 409, code)
+
+		code, _ = do("PUT", "/kv/users/carol", "admin", "")
+		require.Equal(t, 204, code)
+	})
+
+	t.Run("list with pagination", func(t *testing.T) {
+		l := list("/kv/users")
+		require.Equal(t, []kvapi.Entry{
+			{Key: "a/b", Size: 5},
+			{Key: "alice", Size: 5},
+		}, l.Entries)
+		require.Equal(t, "alice", l.Next)
+
+		l = list("/kv/users?after=alice")
+		require.Equal(t, []kvapi.Entry{
+			{Key: "carol"},
+			{Key: "groups", Map: true},
+		}, l.Entries)
+		require.Equal(t, "", l.Next)
+
+		l = list("/kv/users?limit=1&after=carol")
+		require.Equal(t, []kvapi.Entry{{Key: "groups", Map: true}}, l.Entries)
+
+		l = list("/kv")
+		require.Equal(t, []kvapi.Entry{{Key: "users", Map: true}}, l.Entries)
+
+		code, _ := do("GET", "/kv/users?limit=x", "reader", "")
+		require.Equal(t, 400, code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		code, _ := do("DELETE", "/kv/users", "admin", "")
+		require.Equal(t, 204, code)
+
+		code, _ = do("DELETE", "/kv/users", "admin", "")
+		require.Equal(t, 404, code)
+
+		code, _ = do("DELETE", "/kv/", "admin", "")
+		require.Equal(t, 400, code)
+	})
+}
+
+func TestRequiresAuthorization(t *testing.T) {
+	_, err := boltimore.Open(t.TempDir(), kvapi.Endpoints("/kv"))
+	require.Error(t, err)
+}
@@ -0,0 +1,242 @@
+package boltimore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/draganm/boltimore/clock"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+type LifecycleContext struct {
+	DB     *DB
+	Logger *zap.SugaredLogger
+}
+
+// OnStart registers a hook that is run at the end of Open, before the cron
+// scheduler and the background workers are started.
+// An error returned by the hook makes Open fail. The OnStop hooks registered
+// before the failed hook are run in reverse order, so the hooks that have
+// already started can release their resources.
+func OnStart(fn func(lc *LifecycleContext) error) Option {
+	return Option(func(b *Boltimore) error {
+		b.onStart = append(b.onStart, fn)
+		return nil
+	})
+}
+
+// OnStop registers a hook that is run by Close after the background workers
+// have stopped and before the database is closed.
+// Hooks are run in reverse order of registration.
+func OnStop(fn func(lc *LifecycleContext) error) Option {
+	return Option(func(b *Boltimore) error {
+		b.onStop = append(b.onStop, stopHook{fn: fn, startHooks: len(b.onStart)})
+		return nil
+	})
+}
+
+// stopHook is an OnStop hook and the number of OnStart hooks registered
+// before it.
+type stopHook struct {
+	fn         func(lc *LifecycleContext) error
+	startHooks int
+}
+
+// runStopHooks runs the stop hooks registered before the start hook with the
+// index started in reverse order, all of them when every start hook has run.
+func (b *Boltimore) runStopHooks(started int) error {
+	var err error
+	for i := len(b.onStop) - 1; i >= 0; i-- {
+		h := b.onStop[i]
+		if h.startHooks <= started {
+			err = multierr.Append(err, h.fn(b.lifecycleContext()))
+		}
+	}
+	return err
+}
+
+func (b *Boltimore) lifecycleContext() *LifecycleContext {
+	return &LifecycleContext{
+		DB:     b.DB,
+		Logger: b.logger.With("lifecycle", "hook"),
+	}
+}
+
+const (
+	WorkerStateRunning  = "running"
+	WorkerStateBackoff  = "backoff"
+	WorkerStateFinished = "finished"
+	WorkerStateStopped  = "stopped"
+)
+
+type WorkerStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	Restarts    int        `json:"restarts"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+type WorkerContext struct {
+	DB     *DB
+	Logger *zap.SugaredLogger
+	Clock  clock.Clock
+}
+
+const (
+	workerMinBackoff = time.Second
+	workerMaxBackoff = time.Minute
+)
+
+var workerBackoff = ExponentialBackoff(workerMinBackoff, workerMaxBackoff)
+
+// Worker runs fn in a goroutine from the end of Open until Close.
+// When fn returns an error or panics, it is restarted with exponential backoff.
+// When fn returns nil, the worker is finished and not restarted.
+// The context passed to fn is cancelled when Close is called.
+func Worker(name string, fn func(ctx context.Context, wc *WorkerContext) error) Option {
+	return Option(func(b *Boltimore) error {
+		for _, w := range b.workers {
+			if w.status.Name == name {
+				return errors.Errorf("worker %s is registered twice", name)
+			}
+		}
+
+		w := &supervisedWorker{
+			b:      b,
+			fn:     fn,
+			mu:     new(sync.Mutex),
+			logger: b.logger.With("worker", name),
+			status: WorkerStatus{
+				Name:  name,
+				State: WorkerStateStopped,
+			},
+		}
+
+		b.workers = append(b.workers, w)
+		b.goBackground(w.supervise)
+
+		return nil
+	})
+}
+
+// WorkerStatuses returns the status of all workers in order of registration.
+func (b *Boltimore) WorkerStatuses() []WorkerStatus {
+	statuses := make([]WorkerStatus, len(b.workers))
+	for i, w := range b.workers {
+		statuses[i] = w.getStatus()
+	}
+	return statuses
+}
+
+// WorkerStatusEndpoint adds a GET endpoint responding with the status of all workers.
+func WorkerStatusEndpoint(path string) Option {
+	return Option(func(b *Boltimore) error {
+		b.addEndpoint("GET", path, func(rc *RequestContext) error {
+			return rc.RespondWithJSON(b.WorkerStatuses())
+		})
+		return nil
+	})
+}
+
+type supervisedWorker struct {
+	b      *Boltimore
+	fn     func(ctx context.Context, wc *WorkerContext) error
+	logger *zap.SugaredLogger
+	mu     *sync.Mutex
+	status WorkerStatus
+}
+
+func (w *supervisedWorker) getStatus() WorkerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *supervisedWorker) updateStatus(fn func(s *WorkerStatus)) {
+	w.mu.Lock()
+	fn(&w.status)
+	w.mu.Unlock()
+}
+
+func (w *supervisedWorker) supervise(ctx context.Context) {
+	c := w.b.clock
+	failures := 0
+
+	for {
+		startedAt := c.Now()
+		w.updateStatus(func(s *WorkerStatus) {
+			s.State = WorkerStateRunning
+			s.StartedAt = &startedAt
+		})
+
+		err := w.run(ctx)
+
+		if ctx.Err() != nil {
+			w.updateStatus(func(s *WorkerStatus) {
+				s.State = WorkerStateStopped
+			})
+			return
+		}
+
+		if err == nil {
+			w.logger.Info("worker finished")
+			w.updateStatus(func(s *WorkerStatus) {
+				s.State = WorkerStateFinished
+			})
+			return
+		}
+
+		now := c.Now()
+
+		// a worker that has been running longer than the maximal backoff
+		// is considered healthy again
+		if now.Sub(startedAt) > workerMaxBackoff {
+			failures = 0
+		}
+		failures++
+
+		delay := workerBackoff(failures)
+		w.logger.With("error", err, "restartIn", delay).Error("worker failed")
+
+		w.updateStatus(func(s *WorkerStatus) {
+			s.State = WorkerStateBackoff
+			s.LastError = err.Error()
+			s.LastErrorAt = &now
+		})
+
+		t := c.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			w.updateStatus(func(s *WorkerStatus) {
+				s.State = WorkerStateStopped
+			})
+			return
+		case <-t.C():
+		}
+
+		w.updateStatus(func(s *WorkerStatus) {
+			s.Restarts++
+		})
+	}
+}
+
+func (w *supervisedWorker) run(ctx context.Context) (err error) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			err = errors.Errorf("panic: %v", p)
+		}
+	}()
+
+	return w.fn(ctx, &WorkerContext{
+		DB:     w.b.DB,
+		Logger: w.logger,
+		Clock:  w.b.clock,
+	})
+}
@@ -0,0 +1,189 @@
+package boltimore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+
+	t.Run("hooks are called in order", func(t *testing.T) {
+		calls := []string{}
+
+		hook := func(name string) func(lc *boltimore.LifecycleContext) error {
+			return func(lc *boltimore.LifecycleContext) error {
+				calls = append(calls, name)
+				return nil
+			}
+		}
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.OnStart(hook("start 1")),
+			boltimore.OnStop(hook("stop 1")),
+			boltimore.OnStart(hook("start 2")),
+			boltimore.OnStop(hook("stop 2")),
+		)
+		require.NoError(t, err)
+		require.Equal(t, []string{"start 1", "start 2"}, calls)
+
+		require.NoError(t, b.Close())
+		require.Equal(t, []string{"start 1", "start 2", "stop 2", "stop 1"}, calls)
+	})
+
+	t.Run("failing start hook", func(t *testing.T) {
+		_, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.OnStart(func(lc *boltimore.LifecycleContext) error {
+				return errors.New("failed")
+			}),
+		)
+		require.EqualError(t, err, "while running start hook: failed")
+	})
+
+	t.Run("failing start hook stops the started hooks", func(t *testing.T) {
+		calls := []string{}
+
+		hook := func(name string, err error) func(lc *boltimore.LifecycleContext) error {
+			return func(lc *boltimore.LifecycleContext) error {
+				calls = append(calls, name)
+				return err
+			}
+		}
+
+		_, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.OnStop(hook("stop 0", nil)),
+			boltimore.OnStart(hook("start 1", nil)),
+			boltimore.OnStop(hook("stop 1", nil)),
+			boltimore.OnStart(hook("start 2", errors.New("failed"))),
+			boltimore.OnStop(hook("stop 2", nil)),
+		)
+		require.EqualError(t, err, "while running start hook: failed")
+		require.Equal(t, []string{"start 1", "start 2", "stop 1", "stop 0"}, calls)
+	})
+
+	t.Run("failing stop hook", func(t *testing.T) {
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.OnStop(func(lc *boltimore.LifecycleContext) error {
+				return errors.New("failed")
+			}),
+		)
+		require.NoError(t, err)
+		require.EqualError(t, b.Close(), "failed")
+	})
+
+}
+
+func TestWorker(t *testing.T) {
+
+	t.Run("worker is cancelled on close", func(t *testing.T) {
+		started := make(chan bool)
+		stopped := false
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Worker("consumer", func(ctx context.Context, wc *boltimore.WorkerContext) error {
+				close(started)
+				<-ctx.Done()
+				stopped = true
+				return ctx.Err()
+			}),
+		)
+		require.NoError(t, err)
+
+		<-started
+		require.Equal(t, boltimore.WorkerStateRunning, b.WorkerStatuses()[0].State)
+
+		require.NoError(t, b.Close())
+		require.True(t, stopped)
+		require.Equal(t, boltimore.WorkerStateStopped, b.WorkerStatuses()[0].State)
+	})
+
+	t.Run("worker is restarted with backoff", func(t *testing.T) {
+		runs := make(chan int)
+		run := 0
+		fc := clocktest.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Clock(fc),
+			boltimore.WorkerStatusEndpoint("/workers"),
+			boltimore.Worker("consumer", func(ctx context.Context, wc *boltimore.WorkerContext) error {
+				run++
+				runs <- run
+				switch run {
+				case 1:
+					return errors.New("failed")
+				case 2:
+					panic("boom")
+				default:
+					return nil
+				}
+			}),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		require.Equal(t, 1, <-runs)
+
+		fc.BlockUntil(1)
+
+		status := b.WorkerStatuses()[0]
+		require.Equal(t, boltimore.WorkerStateBackoff, status.State)
+		require.Equal(t, "failed", status.LastError)
+
+		fc.Advance(time.Second)
+		require.Equal(t, 2, <-runs)
+
+		fc.BlockUntil(1)
+		fc.Advance(time.Second)
+		select {
+		case <-runs:
+			require.Fail(t, "restarted before backoff expired")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		fc.Advance(time.Second)
+		require.Equal(t, 3, <-runs)
+
+		for i := 0; i < 200; i++ {
+			if b.WorkerStatuses()[0].State == boltimore.WorkerStateFinished {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", "/workers", nil))
+		require.Equal(t, 200, rec.Code)
+
+		statuses := []boltimore.WorkerStatus{}
+		err = json.Unmarshal(rec.Body.Bytes(), &statuses)
+		require.NoError(t, err)
+
+		require.Len(t, statuses, 1)
+		require.Equal(t, "consumer", statuses[0].Name)
+		require.Equal(t, boltimore.WorkerStateFinished, statuses[0].State)
+		require.Equal(t, 2, statuses[0].Restarts)
+		require.Equal(t, "panic: boom", statuses[0].LastError)
+	})
+
+	t.Run("duplicate worker name", func(t *testing.T) {
+		fn := func(ctx context.Context, wc *boltimore.WorkerContext) error {
+			return nil
+		}
+		_, err := boltimore.Open(t.TempDir(), boltimore.Worker("w", fn), boltimore.Worker("w", fn))
+		require.EqualError(t, err, "worker w is registered twice")
+	})
+
+}
@@ -0,0 +1,245 @@
+package boltimore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/pkg/errors"
+)
+
+const migrationsMapName = "__migrations"
+
+type migration struct {
+	version int
+	name    string
+	content string
+	fn      func(tx bolted.WriteTx) error
+}
+
+// checksum covers the version, the name and the declared content. Migrations
+// without content keep the checksum of the version and the name only.
+func (m migration) checksum() string {
+	d := fmt.Sprintf("%d:%s", m.version, m.name)
+	if m.content != "" {
+		d = fmt.Sprintf("%s:%s", d, m.content)
+	}
+	s := sha256.Sum256([]byte(d))
+	return hex.EncodeToString(s[:])
+}
+
+type appliedMigration struct {
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+type MigrationStatus struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"appliedAt,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Migration registers a schema migration. Migrations are applied in the order
+// of their versions after all options have been processed, each one in its own
+// write transaction. Versions must start at 1 and must not have gaps.
+// Applied versions are recorded in the database and never applied again.
+// Open refuses to start when an applied migration is registered with a
+// different checksum. Go can't hash the code of fn, so the checksum of a
+// Migration covers only its version and name, see ChecksummedMigration.
+func Migration(version int, name string, fn func(tx bolted.WriteTx) error) Option {
+	return ChecksummedMigration(version, name, "", fn)
+}
+
+// ChecksummedMigration registers a migration like Migration, whose checksum
+// also covers content. Content should change whenever fn changes, e.g. the
+// source of the migration or a revision of it.
+func ChecksummedMigration(version int, name, content string, fn func(tx bolted.WriteTx) error) Option {
+	return Option(func(b *Boltimore) error {
+		if version < 1 {
+			return errors.Errorf("migration version must be positive, got %d", version)
+		}
+
+		for _, m := range b.migrations {
+			if m.version == version {
+				return errors.Errorf("migration version %d is registered twice", version)
+			}
+		}
+
+		b.migrations = append(b.migrations, migration{
+			version: version,
+			name:    name,
+			content: content,
+			fn:      fn,
+		})
+
+		return nil
+	})
+}
+
+// MigrationDryRun makes Open try pending migrations in a transaction that is
+// rolled back instead of applying them. The outcome is passed to report and
+// Open fails with ErrMigrationDryRun, so the application does not run with
+// an unmigrated database.
+func MigrationDryRun(report func(statuses []MigrationStatus)) Option {
+	return Option(func(b *Boltimore) error {
+		b.migrationDryRun = report
+		return nil
+	})
+}
+
+var ErrMigrationDryRun = errors.New("migration dry run, the database has not been migrated")
+
+func (b *Boltimore) runMigrations() error {
+	if len(b.migrations) == 0 && b.migrationDryRun == nil {
+		return nil
+	}
+
+	sort.Slice(b.migrations, func(i, j int) bool {
+		return b.migrations[i].version < b.migrations[j].version
+	})
+
+	for i, m := range b.migrations {
+		if m.version != i+1 {
+			return errors.Errorf("migration version %d is missing", i+1)
+		}
+	}
+
+	applied := map[int]appliedMigration{}
+
+	err := b.DB.read(func(tx bolted.ReadTx) error {
+		ex, err := tx.Exists(migrationsMapName)
+		if err != nil || !ex {
+			return err
+		}
+
+		it, err := tx.Iterator(migrationsMapName)
+		if err != nil {
+			return err
+		}
+
+		for ; !it.Done; it.Next() {
+			v, err := strconv.Atoi(it.Key)
+			if err != nil {
+				return errors.Wrapf(err, "while parsing migration version %q", it.Key)
+			}
+
+			am := appliedMigration{}
+			err = json.Unmarshal(it.Value, &am)
+			if err != nil {
+				return errors.Wrapf(err, "while parsing applied migration %d", v)
+			}
+
+			applied[v] = am
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "while reading applied migrations")
+	}
+
+	statuses := make([]MigrationStatus, len(b.migrations))
+	pending := []migration{}
+
+	for i, m := range b.migrations {
+		statuses[i] = MigrationStatus{
+			Version: m.version,
+			Name:    m.name,
+		}
+
+		am, found := applied[m.version]
+		if !found {
+			pending = append(pending, m)
+			continue
+		}
+
+		if len(pending) > 0 {
+			return errors.Errorf("migration %d is applied, but migration %d is not", m.version, pending[0].version)
+		}
+
+		if am.Checksum != m.checksum() {
+			if am.Name == m.name {
+				return errors.Errorf("checksum mismatch for migration %d (%s): its content has changed since it was applied", m.version, m.name)
+			}
+			return errors.Errorf("checksum mismatch for migration %d: applied as %q, registered as %q", m.version, am.Name, m.name)
+		}
+
+		statuses[i].Applied = true
+		statuses[i].AppliedAt = am.AppliedAt
+		delete(applied, m.version)
+	}
+
+	if len(applied) > 0 {
+		unknown := []int{}
+		for v := range applied {
+			unknown = append(unknown, v)
+		}
+		sort.Ints(unknown)
+		return errors.Errorf("database contains migrations %v which are not registered", unknown)
+	}
+
+	if b.migrationDryRun != nil {
+		err = b.DB.write(func(tx bolted.WriteTx) error {
+			for _, m := range pending {
+				err := m.fn(tx)
+				if err != nil {
+					statuses[m.version-1].Error = err.Error()
+					break
+				}
+			}
+			return ErrMigrationDryRun
+		})
+
+		if err != ErrMigrationDryRun {
+			return errors.Wrap(err, "while running migrations dry run")
+		}
+
+		b.migrationDryRun(statuses)
+		return ErrMigrationDryRun
+	}
+
+	for _, m := range pending {
+		logger := b.logger.With("migration", m.version, "name", m.name)
+		err = b.DB.write(func(tx bolted.WriteTx) error {
+			err := ensureMap(tx, migrationsMapName)
+			if err != nil {
+				return err
+			}
+
+			err = m.fn(tx)
+			if err != nil {
+				return err
+			}
+
+			d, err := json.Marshal(appliedMigration{
+				Name:      m.name,
+				Checksum:  m.checksum(),
+				AppliedAt: b.clock.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			return tx.Put(dbpath.Join(migrationsMapName, fmt.Sprintf("%020d", m.version)), d)
+		})
+
+		if err != nil {
+			logger.With("error", err).Error("migration failed")
+			return errors.Wrapf(err, "while applying migration %d (%s)", m.version, m.name)
+		}
+
+		logger.Info("migration applied")
+	}
+
+	return nil
+}
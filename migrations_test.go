@@ -0,0 +1,196 @@
+package boltimore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+
+	createMap := func(name string) func(tx bolted.WriteTx) error {
+		return func(tx bolted.WriteTx) error {
+			return tx.CreateMap(name)
+		}
+	}
+
+	exists := func(t *testing.T, b *boltimore.Boltimore, pth string) bool {
+		var ex bool
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			var err error
+			ex, err = tx.Exists(pth)
+			return err
+		})
+		require.NoError(t, err)
+		return ex
+	}
+
+	t.Run("applies pending migrations once", func(t *testing.T) {
+		dir := t.TempDir()
+
+		b, err := boltimore.Open(
+			dir,
+			boltimore.Migration(2, "create bar", createMap("foo/bar")),
+			boltimore.Migration(1, "create foo", createMap("foo")),
+		)
+		require.NoError(t, err)
+		require.True(t, exists(t, b, "foo/bar"))
+		require.NoError(t, b.Close())
+
+		b, err = boltimore.Open(
+			dir,
+			boltimore.Migration(1, "create foo", createMap("foo")),
+			boltimore.Migration(2, "create bar", createMap("foo/bar")),
+			boltimore.Migration(3, "create baz", createMap("baz")),
+		)
+		require.NoError(t, err)
+		require.True(t, exists(t, b, "baz"))
+		require.NoError(t, b.Close())
+	})
+
+	t.Run("failed migration is not recorded", func(t *testing.T) {
+		dir := t.TempDir()
+
+		_, err := boltimore.Open(
+			dir,
+			boltimore.Migration(1, "create foo", createMap("foo")),
+			boltimore.Migration(2, "fail", func(tx bolted.WriteTx) error {
+				err := tx.CreateMap("bar")
+				if err != nil {
+					return err
+				}
+				return errors.New("failed")
+			}),
+		)
+		require.EqualError(t, err, "while applying migration 2 (fail): failed")
+
+		b, err := boltimore.Open(
+			dir,
+			boltimore.Migration(1, "create foo", createMap("foo")),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		require.True(t, exists(t, b, "foo"))
+		require.False(t, exists(t, b, "bar"))
+	})
+
+	t.Run("gap in registered versions", func(t *testing.T) {
+		_, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Migration(1, "create foo", createMap("foo")),
+			boltimore.Migration(3, "create bar", createMap("bar")),
+		)
+		require.EqualError(t, err, "migration version 2 is missing")
+	})
+
+	t.Run("duplicate version", func(t *testing.T) {
+		_, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.Migration(1, "create foo", createMap("foo")),
+			boltimore.Migration(1, "create bar", createMap("bar")),
+		)
+		require.EqualError(t, err, "migration version 1 is registered twice")
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+
+		b, err := boltimore.Open(dir, boltimore.Migration(1, "create foo", createMap("foo")))
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		_, err = boltimore.Open(dir, boltimore.Migration(1, "create bar", createMap("bar")))
+		require.EqualError(t, err, `checksum mismatch for migration 1: applied as "create foo", registered as "create bar"`)
+	})
+
+	t.Run("content checksum mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+
+		b, err := boltimore.Open(dir, boltimore.ChecksummedMigration(1, "create foo", "v1", createMap("foo")))
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		b, err = boltimore.Open(dir, boltimore.ChecksummedMigration(1, "create foo", "v1", createMap("foo")))
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		_, err = boltimore.Open(dir, boltimore.ChecksummedMigration(1, "create foo", "v2", createMap("foo")))
+		require.EqualError(t, err, "checksum mismatch for migration 1 (create foo): its content has changed since it was applied")
+
+		_, err = boltimore.Open(dir, boltimore.Migration(1, "create foo", createMap("foo")))
+		require.Error(t, err)
+	})
+
+	t.Run("unknown applied migration", func(t *testing.T) {
+		dir := t.TempDir()
+
+		b, err := boltimore.Open(
+			dir,
+			boltimore.Migration(1, "create foo", createMap("foo")),
+			boltimore.Migration(2, "create bar", createMap("bar")),
+		)
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		_, err = boltimore.Open(dir, boltimore.Migration(1, "create foo", createMap("foo")))
+		require.EqualError(t, err, "database contains migrations [2] which are not registered")
+	})
+
+	t.Run("init functions run after migrations", func(t *testing.T) {
+		migrated := false
+
+		b, err := boltimore.Open(
+			t.TempDir(),
+			boltimore.InitFunction(func(ifc *boltimore.InitFunctionContext) error {
+				return ifc.DB.Read(func(tx bolted.ReadTx) (err error) {
+					migrated, err = tx.Exists("foo")
+					return err
+				})
+			}),
+			boltimore.Migration(1, "create foo", createMap("foo")),
+		)
+		require.NoError(t, err)
+		defer b.Close()
+
+		require.True(t, migrated)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dir := t.TempDir()
+
+		b, err := boltimore.Open(dir, boltimore.Migration(1, "create foo", createMap("foo")))
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		var statuses []boltimore.MigrationStatus
+
+		_, err = boltimore.Open(
+			dir,
+			boltimore.Migration(1, "create foo", createMap("foo")),
+			boltimore.Migration(2, "create bar", createMap("bar")),
+			boltimore.Migration(3, "create foo again", createMap("foo")),
+			boltimore.MigrationDryRun(func(s []boltimore.MigrationStatus) {
+				statuses = s
+			}),
+		)
+		require.Equal(t, boltimore.ErrMigrationDryRun, err)
+
+		require.Len(t, statuses, 3)
+		require.True(t, statuses[0].Applied)
+		require.False(t, statuses[1].Applied)
+		require.Equal(t, "", statuses[1].Error)
+		require.False(t, statuses[2].Applied)
+		require.Equal(t, "bucket already exists", statuses[2].Error)
+
+		b, err = boltimore.Open(dir)
+		require.NoError(t, err)
+		defer b.Close()
+
+		require.False(t, exists(t, b, "bar"))
+	})
+
+}
@@ -0,0 +1,262 @@
+package boltimore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/bolted"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidDatabaseFile = errors.New("invalid database file")
+
+// ErrChangedWhileStaging is returned by ReplaceStaged when the database has
+// been changed while the staging database was filled.
+var ErrChangedWhileStaging = errors.New("database changed while the staging database was filled")
+
+// errSnapshotCopied rolls back the write transaction of SnapshotRaw.
+var errSnapshotCopied = errors.New("snapshot copied")
+
+// SnapshotRaw writes a consistent copy of the bolt database file to w.
+// The file is copied to a temporary file within a write transaction, so no
+// other transaction can change it meanwhile, and then copied to w, so writes
+// are not blocked while w is slow.
+func (b *Boltimore) SnapshotRaw(w io.Writer) error {
+	if b.dbPath == "" {
+		return errors.New("raw snapshots are only supported for databases opened by Open")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.dbPath), "snapshot-")
+	if err != nil {
+		return errors.Wrap(err, "while creating snapshot file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		f, err := os.Open(b.dbPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tmp, f)
+		if err != nil {
+			return err
+		}
+
+		return errSnapshotCopied
+	})
+	if err != errSnapshotCopied {
+		return errors.Wrap(err, "while copying database file")
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, tmp)
+	return err
+}
+
+// RestoreRaw replaces the database with the bolt database file read from r.
+// Background workers, job workers and the cron scheduler are stopped and
+// endpoints are blocked while the database is closed, the file is replaced
+// and the database is reopened. Migrations are applied to the new database;
+// when they fail, the previous database file is put back.
+// b.DB stays valid, transactions started afterwards use the new database.
+// RestoreRaw must not be called from an endpoint added by Endpoint.
+func (b *Boltimore) RestoreRaw(r io.Reader) error {
+	if b.dbPath == "" {
+		return errors.New("raw restores are only supported for databases opened by Open")
+	}
+
+	dir := filepath.Dir(b.dbPath)
+
+	tmp, err := ioutil.TempFile(dir, "restore-")
+	if err != nil {
+		return errors.Wrap(err, "while creating restore file")
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeAndSync(tmp, r)
+	if err != nil {
+		return errors.Wrap(err, "while writing restore file")
+	}
+
+	err = validateDatabaseFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	return b.replaceFile(tmp.Name(), nil)
+}
+
+// StagingContext is passed to the function filling the staging database of
+// ReplaceStaged.
+type StagingContext struct {
+	DB     *bolted.Bolted
+	Logger *zap.SugaredLogger
+}
+
+// ReplaceStaged creates an empty staging database next to the database file,
+// lets fill write to it and replaces the database with it like RestoreRaw.
+// Endpoints and background work are only blocked while the file is replaced,
+// not while the staging database is filled. When the database has been
+// changed meanwhile, it is not replaced and ErrChangedWhileStaging is
+// returned, so no changes are lost. Changes of internal maps, like the job
+// queues, are not taken into account, they are replaced like everything
+// else. Background work changing other maps, like the sweeper of the ttl
+// package deleting expired values, makes ReplaceStaged fail as well.
+// When fill fails, the staging database is removed.
+// ReplaceStaged must not be called from an endpoint added by Endpoint.
+func (b *Boltimore) ReplaceStaged(fill func(sc *StagingContext) error) error {
+	if b.dbPath == "" {
+		return errors.New("staged replaces are only supported for databases opened by Open")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.dbPath), "staging-")
+	if err != nil {
+		return errors.Wrap(err, "while creating staging file")
+	}
+	defer os.Remove(tmp.Name())
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	changes := b.listeners.committedChanges()
+
+	staging, err := bolted.Open(tmp.Name(), 0700)
+	if err != nil {
+		return errors.Wrap(err, "while opening staging database")
+	}
+
+	err = fill(&StagingContext{
+		DB:     staging,
+		Logger: b.logger.With("staging", tmp.Name()),
+	})
+	if err != nil {
+		return multierr.Append(err, staging.Close())
+	}
+
+	err = staging.Close()
+	if err != nil {
+		return errors.Wrap(err, "while closing staging database")
+	}
+
+	return b.replaceFile(tmp.Name(), &changes)
+}
+
+// replaceFile replaces the database file with fileName, which is moved.
+// When changes is not nil, the file is only replaced if no other changes
+// have been committed since.
+func (b *Boltimore) replaceFile(fileName string, changes *uint64) error {
+	b.swapMu.Lock()
+	defer b.swapMu.Unlock()
+
+	b.stopBackground()
+	defer func() {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+		b.startBackground()
+	}()
+
+	// transactions in progress outside of endpoints and background work
+	// are waited for
+	b.DB.mu.Lock()
+	defer b.DB.mu.Unlock()
+
+	// nothing can write anymore
+	if changes != nil && b.listeners.committedChanges() != *changes {
+		return ErrChangedWhileStaging
+	}
+
+	err := b.DB.db.Close()
+	if err != nil {
+		return errors.Wrap(err, "while closing database")
+	}
+
+	previous := b.dbPath + ".previous"
+
+	err = os.Rename(b.dbPath, previous)
+	if err != nil {
+		return multierr.Append(errors.Wrap(err, "while moving database file"), b.reopen())
+	}
+	defer os.Remove(previous)
+
+	err = os.Rename(fileName, b.dbPath)
+	if err == nil {
+		err = b.reopen()
+	}
+
+	if err == nil {
+		err = b.runMigrations()
+		if err != nil {
+			err = multierr.Append(err, b.DB.db.Close())
+		}
+	}
+
+	if err != nil {
+		// put the previous database back
+		err = errors.Wrap(err, "while replacing database file")
+		err = multierr.Append(err, os.Rename(previous, b.dbPath))
+		return multierr.Append(err, b.reopen())
+	}
+
+	b.logger.Info("database file replaced")
+
+	return nil
+}
+
+// reopen opens the database file in place of the closed one, it must be
+// called with the lock of b.DB held.
+func (b *Boltimore) reopen() error {
+	db, err := openDB(b.dbPath, b.Watcher, b.listeners)
+	if err != nil {
+		return errors.Wrap(err, "while opening db")
+	}
+	b.DB.db = db
+	return nil
+}
+
+func writeAndSync(f *os.File, r io.Reader) error {
+	_, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func validateDatabaseFile(fileName string) error {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+
+	// bolt initializes empty files as new databases
+	if fi.Size() == 0 {
+		return errors.Wrap(ErrInvalidDatabaseFile, "file is empty")
+	}
+
+	db, err := bolted.Open(fileName, 0700)
+	if err != nil {
+		return errors.Wrap(ErrInvalidDatabaseFile, err.Error())
+	}
+
+	return db.Close()
+}
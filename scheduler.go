@@ -0,0 +1,123 @@
+package boltimore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/draganm/boltimore/clock"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduler runs cron entries using the instance's clock instead of the
+// wall clock, so that tests can drive it with a fake clock.
+type scheduler struct {
+	mu      *sync.Mutex
+	entries []*schedulerEntry
+	stop    chan struct{}
+	done    chan struct{}
+	running *sync.WaitGroup
+}
+
+type schedulerEntry struct {
+	schedule cron.Schedule
+	fn       func()
+	next     time.Time
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		mu:      new(sync.Mutex),
+		running: new(sync.WaitGroup),
+	}
+}
+
+func (s *scheduler) addFunc(spec string, fn func()) error {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return errors.New("scheduler is already running")
+	}
+
+	s.entries = append(s.entries, &schedulerEntry{schedule: sched, fn: fn})
+
+	return nil
+}
+
+func (s *scheduler) start(c clock.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	now := c.Now()
+	for _, e := range s.entries {
+		e.next = e.schedule.Next(now)
+	}
+
+	go s.run(c, s.stop, s.done)
+}
+
+func (s *scheduler) run(c clock.Clock, stop, done chan struct{}) {
+	defer close(done)
+
+	if len(s.entries) == 0 {
+		<-stop
+		return
+	}
+
+	for {
+		next := s.entries[0].next
+		for _, e := range s.entries[1:] {
+			if e.next.Before(next) {
+				next = e.next
+			}
+		}
+
+		t := c.NewTimer(next.Sub(c.Now()))
+
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case now := <-t.C():
+			for _, e := range s.entries {
+				if e.next.After(now) {
+					continue
+				}
+				s.running.Add(1)
+				go func(fn func()) {
+					defer s.running.Done()
+					fn()
+				}(e.fn)
+				e.next = e.schedule.Next(now)
+			}
+		}
+	}
+}
+
+func (s *scheduler) shutdown() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop = nil
+	s.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+	s.running.Wait()
+}
@@ -0,0 +1,184 @@
+// Package sequence generates IDs within write transactions: monotonic
+// integers, ULIDs and sortable time based IDs. The state of each named
+// generator is stored in the database.
+//
+//	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+//		id, err := sequence.Next(tx, "orders")
+//		...
+//	})
+package sequence
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/pkg/errors"
+)
+
+// __sequences/<name>  kind of the generator followed by its state
+const sequencesMapName = "__sequences"
+
+func init() {
+	boltimore.RegisterInternalMap(sequencesMapName, true)
+}
+
+// The kinds of generators, the state of a generator can only be used by
+// generators of the same kind.
+const (
+	integerKind byte = 'i'
+	ulidKind    byte = 'u'
+	timeIDKind  byte = 't'
+)
+
+var kindNames = map[byte]string{
+	integerKind: "an integer sequence",
+	ulidKind:    "a ULID generator",
+	timeIDKind:  "a time ID generator",
+}
+
+// Next returns the next integer of the sequence, starting with 1.
+func Next(tx bolted.WriteTx, name string) (uint64, error) {
+	return Reserve(tx, name, 1)
+}
+
+// Reserve allocates n integers of the sequence at once and returns the
+// first one.
+func Reserve(tx bolted.WriteTx, name string, n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, errors.New("can't reserve 0 integers")
+	}
+
+	last, err := Current(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if last+n < last {
+		return 0, errors.Errorf("sequence %s overflows", name)
+	}
+
+	err = writeState(tx, name, integerKind, []byte(strconv.FormatUint(last+n, 10)))
+	if err != nil {
+		return 0, err
+	}
+
+	return last + 1, nil
+}
+
+// Current returns the last allocated integer of the sequence, 0 when none
+// has been allocated yet.
+func Current(tx bolted.ReadTx, name string) (uint64, error) {
+	v, found, err := readState(tx, name, integerKind)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "while parsing sequence %s", name)
+	}
+
+	return n, nil
+}
+
+// Allocator hands out integers of a sequence from blocks reserved in their
+// own write transactions, so most calls don't write to the database.
+// Integers of a block that are not handed out before the process stops are
+// skipped. Next must not be called within a write transaction, because
+// reserving a block would wait for it to finish.
+type Allocator struct {
+	db        boltimore.Database
+	name      string
+	blockSize uint64
+
+	mu   *sync.Mutex
+	next uint64
+	end  uint64
+}
+
+// NewAllocator returns an allocator reserving blockSize integers at a time.
+func NewAllocator(db boltimore.Database, name string, blockSize uint64) *Allocator {
+	if blockSize == 0 {
+		blockSize = 1
+	}
+
+	return &Allocator{
+		db:        db,
+		name:      name,
+		blockSize: blockSize,
+		mu:        new(sync.Mutex),
+	}
+}
+
+// Next returns the next integer of the sequence.
+func (a *Allocator) Next() (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.next == a.end {
+		var first uint64
+		err := a.db.Write(func(tx bolted.WriteTx) (err error) {
+			first, err = Reserve(tx, a.name, a.blockSize)
+			return err
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "while reserving a block of sequence %s", a.name)
+		}
+
+		a.next = first
+		a.end = first + a.blockSize
+	}
+
+	n := a.next
+	a.next++
+	return n, nil
+}
+
+// readState returns the state of the generator, which has to be of the kind.
+func readState(tx bolted.ReadTx, name string, kind byte) ([]byte, bool, error) {
+	ex, err := tx.Exists(sequencesMapName)
+	if err != nil || !ex {
+		return nil, false, err
+	}
+
+	pth := dbpath.Join(sequencesMapName, name)
+
+	ex, err = tx.Exists(pth)
+	if err != nil || !ex {
+		return nil, false, err
+	}
+
+	v, err := tx.Get(pth)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(v) == 0 || v[0] != kind {
+		return nil, false, errors.Errorf("sequence %s is not %s", name, kindNames[kind])
+	}
+
+	return v[1:], true, nil
+}
+
+func writeState(tx bolted.WriteTx, name string, kind byte, state []byte) error {
+	if name == "" {
+		return errors.New("sequence name is empty")
+	}
+
+	ex, err := tx.Exists(sequencesMapName)
+	if err != nil {
+		return err
+	}
+
+	if !ex {
+		err = tx.CreateMap(sequencesMapName)
+		if err != nil {
+			return errors.Wrapf(err, "while creating map %s", sequencesMapName)
+		}
+	}
+
+	return tx.Put(dbpath.Join(sequencesMapName, name), append([]byte{kind}, state...))
+}
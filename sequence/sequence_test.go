@@ -0,0 +1,212 @@
+package sequence_test
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore/sequence"
+	"github.com/stretchr/testify/require"
+)
+
+func openDB(t *testing.T) *bolted.Bolted {
+	db, err := bolted.Open(filepath.Join(t.TempDir(), "db"), 0700)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func TestIntegers(t *testing.T) {
+	db := openDB(t)
+
+	err := db.Write(func(tx bolted.WriteTx) error {
+		for i := uint64(1); i <= 3; i++ {
+			n, err := sequence.Next(tx, "orders")
+			require.NoError(t, err)
+			require.Equal(t, i, n)
+		}
+
+		first, err := sequence.Reserve(tx, "orders", 10)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), first)
+
+		n, err := sequence.Next(tx, "orders")
+		require.NoError(t, err)
+		require.Equal(t, uint64(14), n)
+
+		n, err = sequence.Next(tx, "invoices")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), n)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Read(func(tx bolted.ReadTx) error {
+		n, err := sequence.Current(tx, "orders")
+		require.NoError(t, err)
+		require.Equal(t, uint64(14), n)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestAllocator(t *testing.T) {
+	db := openDB(t)
+
+	a := sequence.NewAllocator(db, "orders", 10)
+
+	mu := new(sync.Mutex)
+	seen := map[uint64]bool{}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 7; j++ {
+				n, err := a.Next()
+				require.NoError(t, err)
+				mu.Lock()
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, seen, 35)
+	for i := uint64(1); i <= 35; i++ {
+		require.True(t, seen[i])
+	}
+
+	// a second allocator continues after the blocks of the first one
+	n, err := sequence.NewAllocator(db, "orders", 10).Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(41), n)
+}
+
+func TestULID(t *testing.T) {
+	db := openDB(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := []string{}
+
+	err := db.Write(func(tx bolted.WriteTx) error {
+		for _, at := range []time.Time{now, now, now.Add(-time.Second), now.Add(time.Millisecond)} {
+			id, err := sequence.ULID(tx, "events", at)
+			require.NoError(t, err)
+			require.Len(t, id, 26)
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, sort.StringsAreSorted(ids))
+	for i := 1; i < len(ids); i++ {
+		require.NotEqual(t, ids[i-1], ids[i])
+	}
+
+	// the clock going backwards keeps the time of the last ULID
+	for _, id := range ids[:3] {
+		at, err := sequence.ParseULIDTime(id)
+		require.NoError(t, err)
+		require.True(t, now.Equal(at))
+	}
+
+	at, err := sequence.ParseULIDTime("01ARZ3NDEKTSV4RRFFQ69G5FAV")
+	require.NoError(t, err)
+	require.Equal(t, int64(1469922850259), at.UnixNano()/int64(time.Millisecond))
+
+	err = db.Write(func(tx bolted.WriteTx) error {
+		id, err := sequence.ULID(tx, "other", at)
+		require.NoError(t, err)
+		require.Equal(t, "01ARZ3NDEK", id[:10])
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Write(func(tx bolted.WriteTx) error {
+		_, err := sequence.Next(tx, "events")
+		return err
+	})
+	require.Error(t, err)
+}
+
+func TestTimeID(t *testing.T) {
+	db := openDB(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := []string{}
+
+	err := db.Write(func(tx bolted.WriteTx) error {
+		for _, at := range []time.Time{now, now, now.Add(-time.Hour), now.Add(time.Second)} {
+			id, err := sequence.TimeID(tx, "requests", at)
+			require.NoError(t, err)
+			require.Len(t, id, 13)
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, sort.StringsAreSorted(ids))
+	for i := 1; i < len(ids); i++ {
+		require.NotEqual(t, ids[i-1], ids[i])
+	}
+}
+
+func TestGeneratorKinds(t *testing.T) {
+	db := openDB(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err := db.Write(func(tx bolted.WriteTx) error {
+		// integers with as many digits as the states of ULID and time ID
+		// generators have bytes
+		_, err := sequence.Reserve(tx, "sixteen", 1234567890123456)
+		require.NoError(t, err)
+
+		_, err = sequence.Reserve(tx, "eight", 12345678)
+		require.NoError(t, err)
+
+		_, err = sequence.TimeID(tx, "time", now)
+		require.NoError(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Write(func(tx bolted.WriteTx) error {
+		_, err := sequence.ULID(tx, "sixteen", now)
+		return err
+	})
+	require.Error(t, err)
+
+	err = db.Write(func(tx bolted.WriteTx) error {
+		_, err := sequence.TimeID(tx, "eight", now)
+		return err
+	})
+	require.Error(t, err)
+
+	err = db.Write(func(tx bolted.WriteTx) error {
+		_, err := sequence.ULID(tx, "time", now)
+		return err
+	})
+	require.Error(t, err)
+
+	err = db.Read(func(tx bolted.ReadTx) error {
+		n, err := sequence.Current(tx, "eight")
+		require.NoError(t, err)
+		require.Equal(t, uint64(12345678), n)
+
+		_, err = sequence.Current(tx, "time")
+		require.Error(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+}
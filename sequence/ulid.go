@@ -0,0 +1,154 @@
+package sequence
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/pkg/errors"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs, its order is
+// the order of the ASCII characters, so encoded IDs sort like their values.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID returns a ULID (https://github.com/ulid/spec) of the time now.
+// ULIDs of the same generator are strictly increasing: when now is not after
+// the time of the last ULID, the random part of the last ULID is incremented.
+func ULID(tx bolted.WriteTx, name string, now time.Time) (string, error) {
+	last, found, err := readState(tx, name, ulidKind)
+	if err != nil {
+		return "", err
+	}
+
+	if found && len(last) != 16 {
+		return "", errors.Errorf("invalid state of ULID generator %s", name)
+	}
+
+	id := make([]byte, 16)
+
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	if ms >= 1<<48 {
+		return "", errors.New("time is too late for a ULID")
+	}
+
+	if found && ms <= lastULIDTime(last) {
+		copy(id, last)
+		if !increment(id[6:]) {
+			return "", errors.Errorf("random part of ULID generator %s overflows", name)
+		}
+	} else {
+		binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+		binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+
+		_, err = rand.Read(id[6:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = writeState(tx, name, ulidKind, id)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeULID(id), nil
+}
+
+// ParseULIDTime returns the time encoded in a ULID.
+func ParseULIDTime(ulid string) (time.Time, error) {
+	if len(ulid) != 26 || ulid[0] > '7' {
+		return time.Time{}, errors.Errorf("invalid ULID %q", ulid)
+	}
+
+	ms := uint64(0)
+	for _, c := range []byte(ulid[:10]) {
+		v := indexOf(c)
+		if v < 0 {
+			return time.Time{}, errors.Errorf("invalid ULID %q", ulid)
+		}
+		ms = ms<<5 | uint64(v)
+	}
+
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)), nil
+}
+
+// TimeID returns a sortable ID of the time now with nanosecond precision,
+// 13 characters of Crockford base32. IDs of the same generator are strictly
+// increasing even when the clock doesn't advance.
+func TimeID(tx bolted.WriteTx, name string, now time.Time) (string, error) {
+	last, found, err := readState(tx, name, timeIDKind)
+	if err != nil {
+		return "", err
+	}
+
+	if found && len(last) != 8 {
+		return "", errors.Errorf("invalid state of time ID generator %s", name)
+	}
+
+	n := uint64(now.UnixNano())
+	if found {
+		l := binary.BigEndian.Uint64(last)
+		if n <= l {
+			n = l + 1
+		}
+	}
+
+	state := make([]byte, 8)
+	binary.BigEndian.PutUint64(state, n)
+
+	err = writeState(tx, name, timeIDKind, state)
+	if err != nil {
+		return "", err
+	}
+
+	// 13 characters hold 65 bits, the first one only the 4 highest bits
+	id := make([]byte, 13)
+	for i := 12; i >= 0; i-- {
+		id[i] = crockford[n&31]
+		n >>= 5
+	}
+
+	return string(id), nil
+}
+
+func lastULIDTime(id []byte) uint64 {
+	return uint64(binary.BigEndian.Uint16(id[0:2]))<<32 | uint64(binary.BigEndian.Uint32(id[2:6]))
+}
+
+// increment adds 1 to the big endian number, false on overflow.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes the 128 bits as 26 characters, the first one holds
+// only the 3 highest bits.
+func encodeULID(id []byte) string {
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+
+	s := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(s)
+}
+
+func indexOf(c byte) int {
+	for i := 0; i < len(crockford); i++ {
+		if crockford[i] == c {
+			return i
+		}
+	}
+	return -1
+}
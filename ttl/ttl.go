@@ -0,0 +1,306 @@
+// Package ttl stores values that expire. Reads treat expired values as
+// absent, Sweeper deletes them in the background.
+//
+//	err := rc.DB.Write(func(tx bolted.WriteTx) error {
+//		return ttl.Put(tx, "sessions/"+id, session, time.Now().Add(time.Hour))
+//	})
+package ttl
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/internal/paths"
+	"github.com/pkg/errors"
+)
+
+// The expiry of each value is stored twice, by path to look it up and by
+// expiry time to find the expired values.
+//
+// __ttl/paths/<path>             expiry time
+// __ttl/expiries/<time><path>    path
+const (
+	ttlMapName      = "__ttl"
+	pathsMapName    = "paths"
+	expiriesMapName = "expiries"
+)
+
+func init() {
+	boltimore.RegisterInternalMap(ttlMapName, true)
+}
+
+const defaultBatchSize = 1000
+
+var ErrNotFound = errors.New("not found")
+
+// Put writes the value at pth, which expires at expiresAt. A zero expiresAt
+// writes a value that does not expire.
+// Values written with an expiry have to be overwritten and deleted with Put
+// and Delete, otherwise the expiry is kept.
+func Put(tx bolted.WriteTx, pth string, value []byte, expiresAt time.Time) error {
+	pth, err := normalizePath(pth)
+	if err != nil {
+		return err
+	}
+
+	err = removeExpiry(tx, pth)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Put(pth, value)
+	if err != nil {
+		return err
+	}
+
+	if expiresAt.IsZero() {
+		return nil
+	}
+
+	err = ensureMaps(tx)
+	if err != nil {
+		return err
+	}
+
+	at := encodeTime(expiresAt)
+
+	err = tx.Put(dbpath.Join(ttlMapName, pathsMapName, pth), at)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(dbpath.Join(ttlMapName, expiriesMapName, string(at)+pth), []byte(pth))
+}
+
+// Get returns the value at pth, ErrNotFound when it does not exist or has
+// expired at now.
+func Get(tx bolted.ReadTx, pth string, now time.Time) ([]byte, error) {
+	ex, err := Exists(tx, pth, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ex {
+		return nil, errors.Wrap(ErrNotFound, pth)
+	}
+
+	return tx.Get(pth)
+}
+
+// Exists returns whether the value at pth exists and has not expired at now.
+func Exists(tx bolted.ReadTx, pth string, now time.Time) (bool, error) {
+	pth, err := normalizePath(pth)
+	if err != nil {
+		return false, err
+	}
+
+	ex, err := paths.Exists(tx, pth)
+	if err != nil || !ex {
+		return false, err
+	}
+
+	expiresAt, found, err := ExpiresAt(tx, pth)
+	if err != nil {
+		return false, err
+	}
+
+	return !found || now.Before(expiresAt), nil
+}
+
+// ExpiresAt returns when the value at pth expires, false if it has no expiry.
+func ExpiresAt(tx bolted.ReadTx, pth string) (time.Time, bool, error) {
+	pth, err := normalizePath(pth)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	at, found, err := expiry(tx, pth)
+	if err != nil || !found {
+		return time.Time{}, false, err
+	}
+
+	return decodeTime(at), true, nil
+}
+
+// Delete deletes the value at pth and its expiry.
+func Delete(tx bolted.WriteTx, pth string) error {
+	pth, err := normalizePath(pth)
+	if err != nil {
+		return err
+	}
+
+	err = removeExpiry(tx, pth)
+	if err != nil {
+		return err
+	}
+
+	return tx.Delete(pth)
+}
+
+// Sweep deletes at most limit values that have expired at now and returns
+// the number of deleted values.
+func Sweep(tx bolted.WriteTx, now time.Time, limit int) (int, error) {
+	ex, err := tx.Exists(ttlMapName)
+	if err != nil || !ex {
+		return 0, err
+	}
+
+	it, err := tx.Iterator(dbpath.Join(ttlMapName, expiriesMapName))
+	if err != nil {
+		return 0, err
+	}
+
+	nowKey := string(encodeTime(now))
+
+	expired := []string{}
+	for ; !it.Done && len(expired) < limit; it.Next() {
+		// keys start with the expiry time
+		if it.Key[:8] > nowKey {
+			break
+		}
+		expired = append(expired, string(it.Value))
+	}
+
+	for _, pth := range expired {
+		err = removeExpiry(tx, pth)
+		if err != nil {
+			return 0, err
+		}
+
+		ex, err := paths.Exists(tx, pth)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ex {
+			continue
+		}
+
+		err = tx.Delete(pth)
+		if err != nil {
+			return 0, errors.Wrapf(err, "while deleting %s", pth)
+		}
+	}
+
+	return len(expired), nil
+}
+
+// Sweeper deletes the expired values on the cron schedule, in transactions
+// of at most batchSize values until there are none left. A batchSize of 0
+// defaults to 1000.
+func Sweeper(schedule string, batchSize int) boltimore.Option {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	return boltimore.CronFunction(schedule, func(cfc *boltimore.CronFunctionContext) {
+		now := cfc.Clock.Now()
+		total := 0
+
+		for {
+			var n int
+			err := cfc.DB.Write(func(tx bolted.WriteTx) (err error) {
+				n, err = Sweep(tx, now, batchSize)
+				return err
+			})
+			if err != nil {
+				cfc.Logger.With("error", err).Error("while sweeping expired values")
+				return
+			}
+
+			total += n
+
+			if n < batchSize {
+				break
+			}
+		}
+
+		if total > 0 {
+			cfc.Logger.With("deleted", total).Info("expired values swept")
+		}
+	})
+}
+
+func expiry(tx bolted.ReadTx, pth string) ([]byte, bool, error) {
+	ex, err := tx.Exists(ttlMapName)
+	if err != nil || !ex {
+		return nil, false, err
+	}
+
+	expiryPath := dbpath.Join(ttlMapName, pathsMapName, pth)
+
+	ex, err = tx.Exists(expiryPath)
+	if err != nil || !ex {
+		return nil, false, err
+	}
+
+	at, err := tx.Get(expiryPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return at, true, nil
+}
+
+func removeExpiry(tx bolted.WriteTx, pth string) error {
+	at, found, err := expiry(tx, pth)
+	if err != nil || !found {
+		return err
+	}
+
+	err = tx.Delete(dbpath.Join(ttlMapName, expiriesMapName, string(at)+pth))
+	if err != nil {
+		return err
+	}
+
+	return tx.Delete(dbpath.Join(ttlMapName, pathsMapName, pth))
+}
+
+func ensureMaps(tx bolted.WriteTx) error {
+	for _, m := range []string{
+		ttlMapName,
+		dbpath.Join(ttlMapName, pathsMapName),
+		dbpath.Join(ttlMapName, expiriesMapName),
+	} {
+		ex, err := tx.Exists(m)
+		if err != nil {
+			return err
+		}
+
+		if !ex {
+			err = tx.CreateMap(m)
+			if err != nil {
+				return errors.Wrapf(err, "while creating map %s", m)
+			}
+		}
+	}
+	return nil
+}
+
+func normalizePath(pth string) (string, error) {
+	pth, err := paths.Normalize(pth)
+	if err != nil {
+		return "", err
+	}
+
+	if pth == "" {
+		return "", errors.New("the root has no expiry")
+	}
+
+	return pth, nil
+}
+
+// encodeTime encodes the time as big endian unix nanoseconds, which sort
+// in the order of the times for times after 1970.
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
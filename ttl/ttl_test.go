@@ -0,0 +1,236 @@
+package ttl_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/boltimore"
+	"github.com/draganm/boltimore/backup"
+	"github.com/draganm/boltimore/clock/clocktest"
+	"github.com/draganm/boltimore/ttl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("sessions")
+		if err != nil {
+			return err
+		}
+
+		err = ttl.Put(tx, "sessions/short", []byte("1"), now.Add(time.Minute))
+		if err != nil {
+			return err
+		}
+
+		err = ttl.Put(tx, "sessions/long", []byte("2"), now.Add(time.Hour))
+		if err != nil {
+			return err
+		}
+
+		return ttl.Put(tx, "sessions/forever", []byte("3"), time.Time{})
+	})
+	require.NoError(t, err)
+
+	get := func(pth string, at time.Time) ([]byte, error) {
+		var v []byte
+		err := b.DB.Read(func(tx bolted.ReadTx) (err error) {
+			v, err = ttl.Get(tx, pth, at)
+			return err
+		})
+		return v, err
+	}
+
+	t.Run("before expiry", func(t *testing.T) {
+		v, err := get("sessions/short", now)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), v)
+
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			at, found, err := ttl.ExpiresAt(tx, "sessions/short")
+			require.NoError(t, err)
+			require.True(t, found)
+			require.True(t, at.Equal(now.Add(time.Minute)))
+
+			_, found, err = ttl.ExpiresAt(tx, "sessions/forever")
+			require.NoError(t, err)
+			require.False(t, found)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("after expiry", func(t *testing.T) {
+		_, err := get("sessions/short", now.Add(time.Minute))
+		require.Equal(t, ttl.ErrNotFound, errors.Cause(err))
+
+		v, err := get("sessions/forever", now.Add(24*time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []byte("3"), v)
+
+		_, err = get("sessions/missing/child", now)
+		require.Equal(t, ttl.ErrNotFound, errors.Cause(err))
+	})
+
+	t.Run("overwriting removes the expiry", func(t *testing.T) {
+		err := b.DB.Write(func(tx bolted.WriteTx) error {
+			return ttl.Put(tx, "sessions/long", []byte("4"), time.Time{})
+		})
+		require.NoError(t, err)
+
+		v, err := get("sessions/long", now.Add(2*time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []byte("4"), v)
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		var n int
+		err := b.DB.Write(func(tx bolted.WriteTx) (err error) {
+			n, err = ttl.Sweep(tx, now.Add(2*time.Hour), 10)
+			return err
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		err = b.DB.Read(func(tx bolted.ReadTx) error {
+			ex, err := tx.Exists("sessions/short")
+			require.NoError(t, err)
+			require.False(t, ex)
+
+			ex, err = tx.Exists("sessions/long")
+			require.NoError(t, err)
+			require.True(t, ex)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
+
+func TestSweeper(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := clocktest.NewFake(start)
+
+	b, err := boltimore.Open(
+		t.TempDir(),
+		boltimore.Clock(fc),
+		ttl.Sweeper("@hourly", 3),
+	)
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("tokens")
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 10; i++ {
+			err = ttl.Put(tx, fmt.Sprintf("tokens/%d", i), []byte("token"), start.Add(time.Duration(i)*time.Minute))
+			if err != nil {
+				return err
+			}
+		}
+
+		return ttl.Put(tx, "tokens/later", []byte("token"), start.Add(2*time.Hour))
+	})
+	require.NoError(t, err)
+
+	count := func() int {
+		n := 0
+		err := b.DB.Read(func(tx bolted.ReadTx) error {
+			it, err := tx.Iterator("tokens")
+			if err != nil {
+				return err
+			}
+			for ; !it.Done; it.Next() {
+				n++
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return n
+	}
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Hour)
+
+	for i := 0; i < 200 && count() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Equal(t, 1, count())
+}
+
+func TestSweepInIncrementalBackup(t *testing.T) {
+	b, err := boltimore.Open(t.TempDir(), backup.ChangeLog())
+	require.NoError(t, err)
+	defer b.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		err := tx.CreateMap("sessions")
+		if err != nil {
+			return err
+		}
+
+		return ttl.Put(tx, "sessions/short", []byte("1"), now.Add(time.Minute))
+	})
+	require.NoError(t, err)
+
+	full := new(bytes.Buffer)
+	var since uint64
+	err = b.DB.Read(func(tx bolted.ReadTx) (err error) {
+		since, err = backup.ChangeSequence(tx)
+		if err != nil {
+			return err
+		}
+		return backup.Backup(tx, "", full)
+	})
+	require.NoError(t, err)
+
+	err = b.DB.Write(func(tx bolted.WriteTx) error {
+		n, err := ttl.Sweep(tx, now.Add(time.Hour), 10)
+		require.Equal(t, 1, n)
+		return err
+	})
+	require.NoError(t, err)
+
+	incremental := new(bytes.Buffer)
+	err = b.DB.Read(func(tx bolted.ReadTx) error {
+		return backup.BackupSince(tx, "", since, incremental)
+	})
+	require.NoError(t, err)
+
+	restored, err := boltimore.Open(t.TempDir())
+	require.NoError(t, err)
+	defer restored.Close()
+
+	err = restored.DB.Write(func(tx bolted.WriteTx) error {
+		return backup.RestoreChain(tx, []io.Reader{full, incremental}, backup.RestoreOptions{})
+	})
+	require.NoError(t, err)
+
+	// the removed expiry is deleted by the incremental backup
+	err = restored.DB.Read(func(tx bolted.ReadTx) error {
+		ex, err := tx.Exists("sessions/short")
+		require.NoError(t, err)
+		require.False(t, ex)
+
+		_, found, err := ttl.ExpiresAt(tx, "sessions/short")
+		require.False(t, found)
+		return err
+	})
+	require.NoError(t, err)
+}